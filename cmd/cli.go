@@ -2,11 +2,15 @@ package filedownloader
 
 import (
 	"bufio"
+	"fmt"
 	"log"
 	_url "net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	ihttp "github.com/sysgoblin/godownload/internal/http"
 	"github.com/urfave/cli/v2"
 )
 
@@ -49,6 +53,35 @@ func readFile(filename string) ([]string, error) {
 	return urls, nil
 }
 
+// parseListLine reads a line of the --file list, a url optionally followed by mirrors of the file and its checksum,
+// separated by tabs or spaces, e.g. "https://example.com/a.zip	https://mirror.example.org/a.zip	sha256:9f86d0...".
+// the file is named after the first url.
+func parseListLine(line string) (*Download, error) {
+	d := &Download{}
+	for _, field := range strings.Fields(line) {
+		if !strings.Contains(field, `://`) {
+			if _, err := ihttp.ParseChecksum(field); err != nil {
+				return nil, err
+			}
+			d.Checksum = field
+			continue
+		}
+		fn, err := validateURL(field)
+		if err != nil {
+			return nil, err
+		}
+		if d.URL != "" {
+			d.Mirrors = append(d.Mirrors, field)
+			continue
+		}
+		d.URL, d.LocalFilePath = field, fn
+	}
+	if d.URL == "" {
+		return nil, fmt.Errorf(`no url in line %q`, line)
+	}
+	return d, nil
+}
+
 // basic wrapper for fuso to cli app to use
 func GoDownload(ctx *cli.Context) error {
 	url := ctx.String("url")
@@ -57,6 +90,14 @@ func GoDownload(ctx *cli.Context) error {
 	threads := ctx.Int("threads")
 	retries := ctx.Int("retries")
 	timeout := ctx.Int("timeout")
+	segments := ctx.Int("segments")
+	var limit int64
+	if rate := ctx.String("limit-rate"); rate != "" {
+		var err error
+		if limit, err = ParseRate(rate); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	proxy := ""
 	if tor {
@@ -67,9 +108,11 @@ func GoDownload(ctx *cli.Context) error {
 	config := &Config{
 		MaxDownloadThreads:     threads,
 		MaxRetry:               retries,
-		DownloadTimeoutMinutes: timeout,
+		DownloadTimeout:        time.Duration(timeout) * time.Minute,
 		RequiresDetailProgress: false,
 		Proxy:                  proxy,
+		SegmentsPerFile:        segments,
+		MaxBytesPerSecond:      limit,
 	}
 
 	if url != "" {
@@ -94,15 +137,18 @@ func GoDownload(ctx *cli.Context) error {
 		// download each url in the slice
 		fdl := New(config)
 		var downloadFiles []*Download
-		for _, url := range urls {
-			// validate the url is valid
-			fn, err := validateURL(url)
+		for _, line := range urls {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			// validate the url and checksum are valid
+			d, err := parseListLine(line)
 			if err != nil {
 				log.Fatal(err)
 			}
-			downloadFiles = append(downloadFiles, &Download{URL: url, LocalFilePath: fn})
+			downloadFiles = append(downloadFiles, d)
 		}
-		err = fdl.MultipleFileDownload(downloadFiles)
+		_, err = fdl.MultipleFileDownload(downloadFiles)
 		if err != nil {
 			log.Fatal(err)
 		}
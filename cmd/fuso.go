@@ -2,11 +2,16 @@ package filedownloader
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	logger "log"
+	"math"
+	"net/http"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ihttp "github.com/sysgoblin/godownload/internal/http"
@@ -14,53 +19,156 @@ import (
 
 const (
 	StateReady       state = `ready`       // StateReady is first state of instance
+	StateQueued      state = `queued`      // StateQueued is when a single download waits for a download thread
 	StateDownloading state = `downloading` // StateDownloading is when the download started
+	StatePaused      state = `paused`      // StatePaused is when a single download waits for Resume
 	StateDone        state = `done`        // StateDone is when the download has finished or cancelled
+	StateFailed      state = `failed`      // StateFailed is when a single download gave up after all retries
+	StateCancelled   state = `cancelled`   // StateCancelled is when a single download was cancelled before it was done
 )
 
 var (
-	ErrDownload = errors.New(`file download error`) // ErrDownload error component of downloader
+	ErrDownload            = errors.New(`file download error`) // ErrDownload error component of downloader
+	ErrClosed              = errors.New(`filedownloader is closed`)
+	ErrStalled             = errors.New(`download stalled`) // ErrStalled connection was aborted by Config.StallTimeout or Config.MinSpeed
+	ErrNotFound            = ihttp.ErrNotFound              // ErrNotFound server answered 404 or 410
+	ErrRangeNotSatisfiable = ihttp.ErrRangeNotSatisfiable   // ErrRangeNotSatisfiable server refused the requested range
+	ErrShortBody           = ihttp.ErrShortBody             // ErrShortBody connection ended before the whole file arrived
+	ErrWrite               = ihttp.ErrWrite                 // ErrWrite downloaded bytes could not be stored
+	ErrContentRange        = ihttp.ErrContentRange          // ErrContentRange resumed response doesn't fit the requested range
+	ErrRemoteChanged       = ihttp.ErrRemoteChanged         // ErrRemoteChanged file changed on server while it was downloaded in segments
+	ErrChecksumMismatch    = ihttp.ErrChecksumMismatch      // ErrChecksumMismatch downloaded file doesn't have the expected digest
 )
 
+// StatusError is returned when the server answered with an unexpected http status.
+type StatusError = ihttp.StatusError
+
+// WriteError is returned when the local file could not be created or written.
+type WriteError = ihttp.WriteError
+
+// SourceError is returned when a connection to one of the urls of a download failed, URL tells which one.
+type SourceError = ihttp.SourceError
+
+// ChecksumError is returned when the downloaded file doesn't have the expected digest.
+type ChecksumError = ihttp.ChecksumError
+
 type state string
 
 // FileDownloader main structure
 type FileDownloader struct {
 	Conf                   *Config
-	TotalFilesSize         int64
-	ProgressChan           chan float64               // 0.0 to 1.0 float value indicates progress of downloading
-	DownloadBytesPerSecond chan int64                 // downloaded bytes in last second
+	TotalFilesSize         int64                      // size of the files whose size is known, forgotten downloads not included. Read it with atomic.LoadInt64 while downloading
+	ProgressChan           chan float64               // 0.0 to 1.0 float value indicates progress of downloading, closed by Close. See Stats for more
+	DownloadBytesPerSecond chan int64                 // downloaded bytes in last second, closed by Close
 	Err                    error                      // error object
-	Cancel                 func()                     // cancel downloading, if this method is called.
+	Cancel                 func()                     // cancel downloading, if this method is called. It can be called any time after New
 	LogFunc                func(param ...interface{}) // logging function
-	State                  state                      // downloading state of filedownloader
+	State                  state                      // downloading state of filedownloader, StateDownloading while its download threads run
+
+	client    *http.Client    // http client of this downloader built from Conf
+	clientErr error           // error of building the client, every download fails with it
+	cancelled <-chan struct{} // closed by Cancel
+	limiter   *ihttp.Limiter  // bandwidth limit of all downloads
+
+	mu         sync.Mutex
+	idle       *sync.Cond              // broadcast when a job finishes
+	jobs       map[JobID]*job          // unfinished jobs and the last Config.KeepFinished finished ones by id
+	finished   []*job                  // finished jobs, oldest first
+	queue      []*job                  // jobs waiting for a download thread, in order of Enqueue
+	lastID     JobID                   // id of the last enqueued job
+	active     int                     // jobs which are not finished
+	paused     int                     // jobs in StatePaused
+	pauseAll   bool                    // PauseAll has been called, new jobs are paused too
+	pool       *pool                   // running download threads, nil before Start
+	started    bool                    // Start has been called, the threads run until Close
+	batches    int                     // running calls of SimpleFileDownload and MultipleFileDownload
+	closed     bool                    // Close has been called
+	ready      *sync.Cond              // broadcast when a job may start
+	threads    int                     // number of download threads
+	running    int                     // jobs downloading
+	probes     chan struct{}           // one entry per running size request
+	subs       map[chan Stats]struct{} // channels of Subscribe
+	hosts      map[string]*host        // backoff, breaker and connections of every host
+	dispatched int64                   // number of downloads started
+
+	hookMu    sync.Mutex
+	hookCalls []hookCall // hooks waiting to be called, in order
+	hooking   bool       // a goroutine calls the hooks
 }
 
 // Config filedownloader config
 type Config struct {
-	MaxDownloadThreads     int                        // limit of parallel downloading threads. Default value is 3
-	MaxRetry               int                        // retry count of file downloading, when download fails default is 0
-	DownloadTimeoutMinutes int                        // download timeout minutes, default is 60
+	MaxDownloadThreads     int                        // limit of parallel downloading threads. Default value 0 is 3 threads
+	MaxRetry               int                        // retry count of file downloading, when download fails default is 0. A file failing its checksum is downloaded again once even with 0
+	RetryWait              time.Duration              // wait before the first retry, doubled on every further retry. Default is 1 second
+	DownloadTimeout        time.Duration              // timeout of downloading all files, default is none. Deadlines of the context passed in apply as well
+	DownloadTimeoutMinutes int                        // Deprecated: use DownloadTimeout. Used when DownloadTimeout is not set
 	RequiresDetailProgress bool                       // If true you can receive progress value from ProgressChan and downloadBytesPerSecond
 	LogFunc                func(param ...interface{}) // logging function
 	Proxy                  string                     // proxy to use for downloading
+	ConnectTimeout         time.Duration              // timeout of establishing a connection, default is the net/http one
+	ResponseHeaderTimeout  time.Duration              // timeout of waiting for the response headers of a request, default is none
+	TLSClientConfig        *tls.Config                // tls settings like custom root CAs
+	MaxConnsPerHost        int                        // limit of connections to a single host, downloads wait in the queue until their host has a free one. Default is no limit
+	Transport              http.RoundTripper          // transport to send requests with. Proxy, ConnectTimeout, ResponseHeaderTimeout, TLSClientConfig and the transport's own limit of MaxConnsPerHost are ignored when set, the scheduler still applies MaxConnsPerHost
+	HTTPClient             *http.Client               // client to send requests with. Transport and the settings Transport ignores are ignored as well when set
+	SegmentsPerFile        int                        // connections a single file is downloaded with when the server supports ranges. Default 1 is one connection per file
+	PartSuffix             string                     // suffix of a file while it is downloaded, it gets its final name when complete. Default is ".part"
+	TempDir                string                     // directory for files while they are downloaded, default is next to LocalFilePath. File names have to be unique
+	MaxBytesPerSecond      int64                      // bandwidth limit shared by all downloads, default 0 is unlimited. See SetMaxBytesPerSecond
+	BreakerThreshold       int                        // failed attempts in a row after which a host gets no downloads for BreakerCooldown, default 0 never stops
+	BreakerCooldown        time.Duration              // wait before a stopped host is probed with a single attempt, default is 30 seconds
+	StallTimeout           time.Duration              // an attempt which receives no bytes for this long is aborted and retried, default is no limit
+	MinSpeed               int64                      // an attempt slower than this many bytes per second over MinSpeedPeriod is aborted and retried, default 0 is no limit. Keep it below MaxBytesPerSecond
+	MinSpeedPeriod         time.Duration              // period the speed is measured over for MinSpeed, default is 30 seconds
+	Order                  order                      // which queued download starts next, default is OrderAsGiven. Hosts take turns among equally ranked downloads. Size orders wait up to 5 seconds for the sizes of queued files
+	Hooks                  Hooks                      // functions called when a download is queued, started, progressing, complete or failed
+	KeepFinished           int                        // finished downloads Status and Stats still report, older ones are forgotten. Default 0 keeps the last 100, less than 0 none. See Forget
 }
 
 // Download target url to download and local path to be downloaded
 type Download struct {
-	URL           string // downloading file URL
-	LocalFilePath string // local file path which URL file will be downloaded
+	URL               string   // downloading file URL
+	LocalFilePath     string   // local file path which URL file will be downloaded
+	Checksum          string   // optional expected digest like "sha256:9f86d0...", md5, sha256, sha512 and blake2b are supported
+	MaxBytesPerSecond int64    // optional bandwidth limit of this download, Config.MaxBytesPerSecond applies as well
+	Priority          int      // with Config.Order OrderPriority downloads of higher priority start first, see SetPriority
+	Mirrors           []string // optional further urls of the same file, tried in turn when URL fails. Segments are downloaded from all mirrors which report the same size and ETag
+}
+
+// Result outcome of a single Download
+type Result struct {
+	Download     *Download
+	State        state  // StateDone when the file was downloaded, StateCancelled when it was cancelled, otherwise StateFailed
+	BytesWritten int64  // bytes downloaded and written to the local file over all attempts
+	Resumed      int64  // verified bytes of an earlier run the download continued from, not part of BytesWritten
+	Attempts     int    // number of download attempts including retries
+	StatusCode   int    // http status of the last attempt, 0 if no response was received
+	Digest       string // verified checksum like "sha256:9f86d0...", empty if the Download has none
+	Err          error  // error of the last attempt, nil when done
 }
 
 // New creates file downloader
 func New(config *Config) *FileDownloader {
 	if config == nil {
-		config = &Config{MaxDownloadThreads: 3, MaxRetry: 0, DownloadTimeoutMinutes: 60, RequiresDetailProgress: false}
+		config = &Config{MaxDownloadThreads: 3, MaxRetry: 0, DownloadTimeout: time.Hour, RequiresDetailProgress: false}
 	}
-	if config.MaxDownloadThreads == 0 {
-		panic(`Check Configuration again. You can't download file if MaxDownloadThreads is 0`)
+	instance := &FileDownloader{
+		Conf:    config,
+		jobs:    make(map[JobID]*job),
+		hosts:   make(map[string]*host),
+		threads: downloadThreads(config.MaxDownloadThreads),
+		probes:  make(chan struct{}, maxProbes),
+		limiter: ihttp.NewLimiter(config.MaxBytesPerSecond),
+	}
+	instance.idle = sync.NewCond(&instance.mu)
+	instance.ready = sync.NewCond(&instance.mu)
+	cancelled := make(chan struct{})
+	var cancelOnce sync.Once
+	instance.cancelled = cancelled
+	instance.Cancel = func() {
+		cancelOnce.Do(func() { close(cancelled) })
 	}
-	instance := &FileDownloader{Conf: config}
 	// set default logger if not configured log function is not set.
 	if config.LogFunc == nil {
 		instance.LogFunc = fdlLog
@@ -68,6 +176,17 @@ func New(config *Config) *FileDownloader {
 		// external log function
 		instance.LogFunc = config.LogFunc
 	}
+	if config.HTTPClient != nil {
+		instance.client = config.HTTPClient
+	} else {
+		instance.client, instance.clientErr = ihttp.NewClient(config.Transport, ihttp.ClientOptions{
+			Proxy:                 config.Proxy,
+			ConnectTimeout:        config.ConnectTimeout,
+			ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+			TLSClientConfig:       config.TLSClientConfig,
+			MaxConnsPerHost:       config.MaxConnsPerHost,
+		})
+	}
 	// create progress channels
 	if instance.Conf.RequiresDetailProgress {
 		progress := make(chan float64, 10)
@@ -81,141 +200,169 @@ func New(config *Config) *FileDownloader {
 
 // SimpleFileDownload simply download url file to localPath
 func (m *FileDownloader) SimpleFileDownload(url, localFilePath string) error {
-	if m.State != StateReady {
-		panic(`filedownloader has already started or done`)
-	}
-	m.State = StateDownloading
+	return m.SimpleFileDownloadContext(context.Background(), url, localFilePath)
+}
+
+// SimpleFileDownloadContext download url file to localPath until ctx is done
+func (m *FileDownloader) SimpleFileDownloadContext(ctx context.Context, url, localFilePath string) error {
 	d := Download{URL: url, LocalFilePath: localFilePath}
 	var list []*Download
 	list = append(list, &d)
 	// very simple single file download
-	m.downloadFiles(list)
-	return m.Err
+	results, err := m.downloadFiles(ctx, list)
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return results[0].Err
 }
 
 // MultipleFileDownload downloads multiple files at parallel in configured download threads.
-func (m *FileDownloader) MultipleFileDownload(downloads []*Download) error {
-	if m.State != StateReady {
-		panic(`filedownloader has already started or done`)
-	}
-	m.State = StateDownloading
-	m.downloadFiles(downloads)
-	return m.Err
+// results are in the same order as downloads, the error joins the errors of all failed downloads.
+func (m *FileDownloader) MultipleFileDownload(downloads []*Download) ([]*Result, error) {
+	return m.MultipleFileDownloadContext(context.Background(), downloads)
 }
 
-func (m *FileDownloader) downloadFiles(downloads []*Download) {
-	defer func() {
-		m.State = StateDone
-	}()
+// MultipleFileDownloadContext downloads multiple files like MultipleFileDownload until ctx is done.
+// downloads which didn't finish in time fail with the error of ctx.
+func (m *FileDownloader) MultipleFileDownloadContext(ctx context.Context, downloads []*Download) ([]*Result, error) {
+	return m.downloadFiles(ctx, downloads)
+}
+
+// downloadFiles enqueues downloads and waits for them. The download threads are started if needed,
+// and stopped again when this was the only user of them.
+func (m *FileDownloader) downloadFiles(ctx context.Context, downloads []*Download) ([]*Result, error) {
 	downloadFilesCnt := len(downloads)
 	m.LogFunc(`Download Files: ` + strconv.Itoa(downloadFilesCnt))
-	// context for cancel and timeout
-	ctx, timeoutFunc := context.WithTimeout(context.Background(), time.Minute*time.Duration(m.Conf.DownloadTimeoutMinutes))
-	defer timeoutFunc()
-	// if the url allows head access and returns Content-Length, we can calculate progress of downloading files.
-	var resumableUrls = make(map[string]*resumeInfo)
-	for _, d := range downloads {
-		size, resumable, err := ihttp.GetFileSizeAndResumable(d.URL, m.Conf.Proxy)
-		if err != nil || size < 0 {
-			panic(`Could not get whole size of the downloading file. No progress value is available`)
-		}
-		m.TotalFilesSize += size
-		resumableUrls[d.URL] = &resumeInfo{isResumable: resumable, contentLength: size}
-	}
-	// count up downloaded bytes from download goroutines
-	var downloadedBytes = make(chan int)
-	defer close(downloadedBytes)
-	// observe progress
-	m.progressObserver(ctx, downloadedBytes)
-	m.LogFunc(fmt.Sprintf("Total Download Bytes:: %d", m.TotalFilesSize))
-	// Limit maximum download goroutines since network resource is not inifinite.
-	dlCond := sync.NewCond(&sync.Mutex{})
-	currentThreadCnt := 0
-	var wg sync.WaitGroup
-	// download context
-	ctx2, timeoutFunc := context.WithTimeout(ctx, time.Minute*time.Duration(m.Conf.DownloadTimeoutMinutes))
-	defer timeoutFunc()
-	ctx3, cancelFunc := context.WithCancel(ctx2)
+	// context for timeout
+	ctx, cancelFunc := m.downloadContext(ctx)
 	defer cancelFunc()
-	m.Cancel = cancelFunc
-	// Downlaoding Files
-	for i := 0; i < downloadFilesCnt; i++ {
-		url := downloads[i].URL
-		localPath := downloads[i].LocalFilePath
-		resume, ok := resumableUrls[url]
-		useResume := resume.isResumable && ok
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			defer dlCond.Signal()
-			ihttp.DownloadFile(ctx3, url, localPath, downloadedBytes, useResume, resume.contentLength, m.LogFunc, m.Conf.Proxy)
-		}()
-		currentThreadCnt++
-		// stop for loop when reached to max threads.
-		dlCond.L.Lock()
-		if m.Conf.MaxDownloadThreads < currentThreadCnt {
-			m.LogFunc(`Cond locked. download goroutine reached to max`)
-			dlCond.Wait()
-			m.LogFunc(`Cond released. goes to next file download if more.`)
-			currentThreadCnt--
-		}
-		dlCond.L.Unlock()
+	m.mu.Lock()
+	m.batches++
+	m.mu.Unlock()
+	m.start()
+	jobs := make([]*job, downloadFilesCnt)
+	for i, d := range downloads {
+		jobs[i] = m.enqueue(ctx, d)
 	}
-	m.LogFunc(`Wait group is waiting for download.`)
+	m.LogFunc(`Waiting for download.`)
 	// wait for all download ends.
-	wg.Wait()
-	// at last get the context error
-	m.Err = ctx.Err()
+	results := make([]*Result, downloadFilesCnt)
+	for i, j := range jobs {
+		<-j.done
+		results[i] = m.result(j)
+		if results[i].Err != nil {
+			m.LogFunc(fmt.Sprintf(`Download File Failed[%s]: %v`, j.download.URL, results[i].Err))
+		}
+	}
+	m.mu.Lock()
+	m.batches--
+	m.mu.Unlock()
+	m.shutdown()
+	// at last get the context error, or the errors of failed downloads
+	err := ctx.Err()
+	if err == nil && m.isCancelled() {
+		err = context.Canceled
+	}
+	if err == nil {
+		var errs []error
+		for _, r := range results {
+			if r.Err != nil {
+				errs = append(errs, fmt.Errorf(`%s: %w`, r.Download.URL, r.Err))
+			}
+		}
+		err = errors.Join(errs...)
+	}
+	m.mu.Lock()
+	m.Err = err
+	m.mu.Unlock()
 	m.LogFunc(`All Download Task Done.`)
+	return results, err
 }
 
-func (m *FileDownloader) progressObserver(ctx context.Context, downloadedBytes <-chan int) {
-	var totaloDownloadedBytes int64
-	m.LogFunc(`Total File Size from HTTP head Info::` + strconv.Itoa(int(m.TotalFilesSize)))
-	// every second, print how many bytes downloaded.
-	ticker := time.NewTicker(time.Second)
+// downloadContext derives the context of downloading from ctx, with the configured timeout.
+func (m *FileDownloader) downloadContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := m.Conf.DownloadTimeout
+	if timeout == 0 {
+		timeout = time.Minute * time.Duration(m.Conf.DownloadTimeoutMinutes)
+	}
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// isCancelled reports whether Cancel has been called.
+func (m *FileDownloader) isCancelled() bool {
+	select {
+	case <-m.cancelled:
+		return true
+	default:
+		return false
+	}
+}
 
-	// init the chans for progress and speed
-	m.ProgressChan = make(chan float64)
-	m.DownloadBytesPerSecond = make(chan int64)
+func (m *FileDownloader) progressObserver(ctx context.Context, done chan<- struct{}) {
+	m.LogFunc(`Total File Size from HTTP head Info::` + strconv.Itoa(int(atomic.LoadInt64(&m.TotalFilesSize))))
+	// every second, print how many bytes downloaded.
+	ticker := time.NewTicker(progressInterval)
 
 	go func() {
-		defer close(m.ProgressChan)
-		defer close(m.DownloadBytesPerSecond)
+		defer close(done)
 		defer ticker.Stop()
-		var lastProgress int64
+		last := time.Now()
 	LOOP:
 		for {
 			select {
-			case <-ticker.C:
-				sub := totaloDownloadedBytes - lastProgress
-				m.LogFunc(fmt.Sprintf(`downloaded %d bytes per second, downloaded %d / %d`, sub, totaloDownloadedBytes, m.TotalFilesSize))
-				lastProgress = totaloDownloadedBytes
+			case now := <-ticker.C:
+				// the downloads count their bytes, they are only sampled here.
+				stats, sub := m.sample(now.Sub(last))
+				last = now
+				if stats.Active == 0 && sub == 0 {
+					continue
+				}
+				m.LogFunc(fmt.Sprintf(`downloaded %d bytes per second, downloaded %d / %d`, sub, stats.Done, stats.Total))
 				if m.Conf.RequiresDetailProgress {
-					m.DownloadBytesPerSecond <- sub
-					// send progress value to channel. progress should be between 0.0 to 1.0.
-					p := float64(totaloDownloadedBytes) / float64(m.TotalFilesSize)
-					m.ProgressChan <- p
+					m.sendProgress(stats, sub)
 				}
-			case t := <-downloadedBytes:
-				// m.LogFunc(`Incomming bytes :` + strconv.Itoa(t))
-				totaloDownloadedBytes += int64(t)
 			case <-ctx.Done():
+				// subscribers get the final states
+				m.sample(time.Since(last))
 				m.LogFunc(`Progress Observer Done.`)
 				break LOOP
-			default:
-				// noting to do
 			}
 		}
 		m.LogFunc(`Filedownloader progress observer finished`)
 	}()
 }
 
-func fdlLog(param ...interface{}) {
-	logger.Println(param...)
+// sendProgress sends speed and progress to the channels of RequiresDetailProgress, values nobody reads are dropped.
+func (m *FileDownloader) sendProgress(stats Stats, speed int64) {
+	select {
+	case m.DownloadBytesPerSecond <- speed:
+	default:
+	}
+	// progress should be between 0.0 to 1.0. files of unknown size still count bytes, so it is capped.
+	if stats.Total > 0 {
+		select {
+		case m.ProgressChan <- math.Min(float64(stats.Done)/float64(stats.Total), 1):
+		default:
+		}
+	}
 }
 
-type resumeInfo struct {
-	isResumable   bool
-	contentLength int64
+// partPath where the file of localPath is written while downloading.
+func (m *FileDownloader) partPath(localPath string) string {
+	suffix := m.Conf.PartSuffix
+	if suffix == "" {
+		suffix = ihttp.DefaultPartSuffix
+	}
+	dir := filepath.Dir(localPath)
+	if m.Conf.TempDir != "" {
+		dir = m.Conf.TempDir
+	}
+	return filepath.Join(dir, filepath.Base(localPath)+suffix)
+}
+
+func fdlLog(param ...interface{}) {
+	logger.Println(param...)
 }
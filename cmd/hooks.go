@@ -0,0 +1,99 @@
+package filedownloader
+
+import "time"
+
+// lifecycle hooks of the downloads.
+
+// Hooks functions called when a download changes its state, set the ones you need.
+// Hooks are called one at a time from a goroutine of the FileDownloader, in the order the changes happened,
+// so for each download OnQueued comes first, then OnStart and OnProgress, and OnComplete or OnError last.
+// A slow hook delays the later hooks but not the downloads. Wait, Close and the download methods return
+// after the hooks of their downloads have returned, so hooks must not call them.
+type Hooks struct {
+	OnQueued   func(Event) // download was enqueued
+	OnStart    func(Event) // a download thread started the download, again after Pause or waiting for its host in the queue
+	OnProgress func(Event) // every second while the file is downloaded
+	OnComplete func(Event) // file is complete at Path
+	OnError    func(Event) // download failed or was cancelled, see Err and State
+}
+
+// Event a download at the time of a hook
+type Event struct {
+	ID       JobID
+	Download *Download
+	State    state
+	Path     string        // final path of the file
+	Size     int64         // size of the file, -1 if unknown
+	Done     int64         // bytes of the file on disk
+	Digest   string        // verified checksum of a complete file, empty if the Download has none
+	Attempts int           // download attempts including retries
+	Duration time.Duration // time since the download was started first
+	Err      error         // error of a failed download
+}
+
+// hookCall a hook waiting to be called, after is run when it returned.
+type hookCall struct {
+	hook  func(Event)
+	event Event
+	after func()
+}
+
+// emit queues a call of hook, it must be called with m.mu held so hooks are called in the order of the changes.
+func (m *FileDownloader) emit(hook func(Event), j *job, after func()) {
+	if hook == nil && after == nil {
+		return
+	}
+	m.hookMu.Lock()
+	defer m.hookMu.Unlock()
+	m.hookCalls = append(m.hookCalls, hookCall{hook: hook, event: m.event(j), after: after})
+	if !m.hooking {
+		m.hooking = true
+		go m.callHooks()
+	}
+}
+
+// callHooks calls the queued hooks until there are no more.
+func (m *FileDownloader) callHooks() {
+	for {
+		m.hookMu.Lock()
+		if len(m.hookCalls) == 0 {
+			m.hooking = false
+			m.hookMu.Unlock()
+			return
+		}
+		c := m.hookCalls[0]
+		m.hookCalls = m.hookCalls[1:]
+		m.hookMu.Unlock()
+		if c.hook != nil {
+			c.hook(c.event)
+		}
+		if c.after != nil {
+			c.after()
+		}
+	}
+}
+
+// event must be called with m.mu held.
+func (m *FileDownloader) event(j *job) Event {
+	e := Event{
+		ID:       j.id,
+		Download: j.download,
+		State:    j.result.State,
+		Path:     j.download.LocalFilePath,
+		Size:     -1,
+		Done:     j.progress.Done(),
+		Digest:   j.result.Digest,
+		Attempts: j.progress.Attempts(),
+		Err:      j.result.Err,
+	}
+	if j.info != nil {
+		e.Size = j.info.ContentLength
+	}
+	if j.size > 0 {
+		e.Size = j.size
+	}
+	if !j.started.IsZero() {
+		e.Duration = time.Since(j.started)
+	}
+	return e
+}
@@ -0,0 +1,176 @@
+package filedownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	_url "net/url"
+	"strings"
+	"time"
+
+	ihttp "github.com/sysgoblin/godownload/internal/http"
+)
+
+// backoff and circuit breaking per server, so a throttled or broken host isn't hammered by every queued download.
+
+const defaultBreakerCooldown = 30 * time.Second // wait of an open breaker when Config.BreakerCooldown is not set
+
+// errHostWait an attempt can't start before its host may be tried again, the job goes back to the queue meanwhile.
+var errHostWait = errors.New(`waiting for host`)
+
+// host state of a server shared by the downloads from it, guarded by FileDownloader.mu
+type host struct {
+	name     string
+	failures int           // consecutive failed attempts
+	until    time.Time     // no attempt starts before, set by Retry-After and the open breaker
+	open     bool          // the breaker is open, after until a single attempt probes the host
+	probing  bool          // the probe attempt is running
+	changed  chan struct{} // closed when the probe is done
+	conns    int           // connections of the running downloads
+	served   int64         // when the host started a download last, in order of all started downloads
+}
+
+// hostName the key of the host of url.
+func hostName(url string) string {
+	u, err := _url.Parse(url)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+// host must be called with m.mu held.
+func (m *FileDownloader) host(name string) *host {
+	h, ok := m.hosts[name]
+	if !ok {
+		h = &host{name: name, changed: make(chan struct{})}
+		m.hosts[name] = h
+	}
+	return h
+}
+
+// wait how long an attempt has to wait for h, 0 if it may start now and -1 while the probe is running.
+func (h *host) wait(now time.Time) time.Duration {
+	if now.Before(h.until) {
+		return h.until.Sub(now)
+	}
+	if h.open && h.probing {
+		return -1
+	}
+	return 0
+}
+
+// waitHost waits until an attempt for the host of url may start, every attempt must report to hostResult.
+// When it is the host of the job, own, the thread isn't kept waiting: errHostWait is returned and the scheduler
+// starts the job again once the host may be tried. Returns the error of ctx if it is done first.
+func (m *FileDownloader) waitHost(ctx context.Context, url string, own string) error {
+	for {
+		m.mu.Lock()
+		h := m.host(hostName(url))
+		wait := h.wait(time.Now())
+		if wait == 0 {
+			// the first attempt of an open breaker is the probe
+			h.probing = h.open
+			m.mu.Unlock()
+			return nil
+		}
+		changed := h.changed
+		m.mu.Unlock()
+		if h.name == own {
+			return errHostWait
+		}
+		if wait < 0 {
+			// until the probe is done
+			wait = time.Hour
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// hostResult updates the host of url with the outcome of an attempt, ctx is the one of the attempt.
+// Retry-After holds back every download from the host, and so does the breaker after Config.BreakerThreshold failures in a row.
+func (m *FileDownloader) hostResult(ctx context.Context, url string, err error) {
+	m.mu.Lock()
+	h := m.host(hostName(url))
+	msg := m.updateHost(ctx, h, err, time.Now())
+	h.probing = false
+	close(h.changed)
+	h.changed = make(chan struct{})
+	m.mu.Unlock()
+	m.ready.Broadcast()
+	if msg != "" {
+		m.LogFunc(msg)
+	}
+}
+
+// updateHost must be called with m.mu held, it returns what to log.
+func (m *FileDownloader) updateHost(ctx context.Context, h *host, err error, now time.Time) string {
+	var statusErr *ihttp.StatusError
+	isStatus := errors.As(err, &statusErr)
+	switch {
+	case ctx.Err() != nil || errors.Is(err, ihttp.ErrCancelCopy):
+		// stopped, not failed
+		return ""
+	case err == nil, isStatus && !statusErr.Temporary():
+		// the host answers, whether the file is there or not
+		wasOpen := h.open
+		h.failures, h.open = 0, false
+		if wasOpen {
+			return `Host is back, resuming its downloads[` + h.name + `]`
+		}
+		return ""
+	case errors.Is(err, ihttp.ErrWrite) || errors.Is(err, ihttp.ErrChecksumMismatch) || errors.Is(err, ihttp.ErrRemoteChanged):
+		// local failures and changed files say nothing about the host
+		return ""
+	}
+	h.failures++
+	var msg string
+	if isStatus && statusErr.RetryAfter > 0 && now.Add(statusErr.RetryAfter).After(h.until) {
+		h.until = now.Add(statusErr.RetryAfter)
+		msg = fmt.Sprintf(`Host asked to retry after %s, holding back its downloads[%s]`, statusErr.RetryAfter, h.name)
+	}
+	if threshold := m.Conf.BreakerThreshold; threshold > 0 && (h.open || h.failures >= threshold) {
+		cooldown := m.Conf.BreakerCooldown
+		if cooldown <= 0 {
+			cooldown = defaultBreakerCooldown
+		}
+		h.open = true
+		if now.Add(cooldown).After(h.until) {
+			h.until = now.Add(cooldown)
+		}
+		msg = fmt.Sprintf(`Host failed %d times in a row, stopping its downloads for %s[%s]`, h.failures, cooldown, h.name)
+	}
+	if h.until.After(now) {
+		// wake the download threads when the host may be tried again
+		time.AfterFunc(h.until.Sub(now), m.ready.Broadcast)
+	}
+	return msg
+}
+
+// pruneHosts forgets the hosts which no unfinished job downloads from, once they may be tried again.
+// It must be called with m.mu held.
+func (m *FileDownloader) pruneHosts(now time.Time) {
+	used := make(map[string]bool)
+	for _, j := range m.jobs {
+		if isFinished(j.result.State) {
+			continue
+		}
+		used[j.host] = true
+		for _, mirror := range j.download.Mirrors {
+			used[hostName(mirror)] = true
+		}
+	}
+	for name, h := range m.hosts {
+		if !used[name] && h.conns == 0 && !h.probing && !now.Before(h.until) {
+			delete(m.hosts, name)
+		}
+	}
+}
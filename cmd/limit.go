@@ -0,0 +1,53 @@
+package filedownloader
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// bandwidth limits of the downloads.
+
+// SetMaxBytesPerSecond changes the bandwidth limit shared by all downloads, 0 or less is unlimited.
+// Running downloads slow down or speed up within a fraction of a second.
+func (m *FileDownloader) SetMaxBytesPerSecond(n int64) {
+	m.limiter.SetRate(n)
+}
+
+// SetDownloadMaxBytesPerSecond changes the bandwidth limit of a single job, 0 or less is unlimited.
+// Returns false if the job is unknown.
+func (m *FileDownloader) SetDownloadMaxBytesPerSecond(id JobID, n int64) bool {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	m.mu.Unlock()
+	if ok {
+		j.limiter.SetRate(n)
+	}
+	return ok
+}
+
+// ParseRate parses a bandwidth like "5M", "500k" or "1.5MiB" into bytes per second.
+// The units K, M and G are multiples of 1024, a trailing "B", "iB" or "/s" is ignored.
+func ParseRate(value string) (int64, error) {
+	s := strings.TrimSuffix(strings.TrimSpace(value), `/s`)
+	s = strings.TrimSuffix(strings.TrimSuffix(s, `B`), `i`)
+	unit := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			unit = 1 << 10
+		case 'm', 'M':
+			unit = 1 << 20
+		case 'g', 'G':
+			unit = 1 << 30
+		}
+		if unit > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(n >= 0 && n*float64(unit) < 1<<62) {
+		return 0, fmt.Errorf(`invalid rate %q, expected bytes per second like 500K or 5M`, value)
+	}
+	return int64(n * float64(unit)), nil
+}
@@ -0,0 +1,135 @@
+package filedownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	_url "net/url"
+
+	ihttp "github.com/sysgoblin/godownload/internal/http"
+)
+
+// failover between the mirrors of a download, and segments from several mirrors at once.
+
+// mirrors urls of a Download and what is known about them, used by a single downloadWithRetry.
+type mirrors struct {
+	urls   []string                     // Download.URL first, then Download.Mirrors
+	infos  map[string]*ihttp.RemoteInfo // remote info of the urls which have been asked
+	failed map[string]bool              // urls which failed since the last retry
+}
+
+func newMirrors(d *Download, info *ihttp.RemoteInfo) *mirrors {
+	return &mirrors{
+		urls:   append([]string{d.URL}, d.Mirrors...),
+		infos:  map[string]*ihttp.RemoteInfo{d.URL: info},
+		failed: make(map[string]bool),
+	}
+}
+
+// has reports whether url is one of the urls.
+func (ms *mirrors) has(url string) bool {
+	for _, u := range ms.urls {
+		if u == url {
+			return true
+		}
+	}
+	return false
+}
+
+// mirrorInfo returns the remote info of url, it is asked for the first time.
+// like for Download.URL a mirror which doesn't tell is downloaded without size and resume.
+func (m *FileDownloader) mirrorInfo(ctx context.Context, ms *mirrors, url string) *ihttp.RemoteInfo {
+	if info, ok := ms.infos[url]; ok {
+		return info
+	}
+	info, err := ihttp.GetRemoteInfo(ctx, m.client, url)
+	if err != nil {
+		m.LogFunc(fmt.Sprintf(`Could not get file info of mirror, downloading without size and resume[%s]: %v`, url, err))
+		info = &ihttp.RemoteInfo{ContentLength: -1}
+	}
+	ms.infos[url] = info
+	return info
+}
+
+// segmentMirrors returns the other urls which serve the same file as url and accept ranges,
+// the segments of a download from url can be requested from them as well.
+func (m *FileDownloader) segmentMirrors(ctx context.Context, ms *mirrors, url string) []string {
+	info := ms.infos[url]
+	if len(ms.urls) == 1 || info == nil || !info.Resumable {
+		return nil
+	}
+	var same []string
+	for _, mirror := range ms.urls {
+		if mirror == url || ms.failed[mirror] {
+			continue
+		}
+		other := m.mirrorInfo(ctx, ms, mirror)
+		if !other.Resumable || !info.SameFile(other) {
+			m.LogFunc(fmt.Sprintf(`Mirror doesn't report the same size and ETag, not using it for segments[%s]`, mirror))
+			continue
+		}
+		same = append(same, mirror)
+	}
+	return same
+}
+
+// failover switches req to the next url which didn't fail since the last retry, a mirror failing during
+// a segmented download is dropped. Returns false when every url failed.
+func (m *FileDownloader) failover(ctx context.Context, req *ihttp.Request, ms *mirrors, err error) bool {
+	if len(ms.urls) == 1 {
+		return false
+	}
+	failed := blamedURL(req, err)
+	ms.failed[failed] = true
+	// the urls after the current one come first
+	start := 0
+	for i, url := range ms.urls {
+		if url == req.URL {
+			start = i
+		}
+	}
+	for i := range ms.urls {
+		url := ms.urls[(start+i)%len(ms.urls)]
+		if ms.failed[url] {
+			continue
+		}
+		info := m.mirrorInfo(ctx, ms, url)
+		var segments []string
+		if req.Connections > 1 {
+			segments = m.segmentMirrors(ctx, ms, url)
+		}
+		if url == req.URL {
+			m.LogFunc(`Dropping failed mirror[` + failed + `]`)
+		} else {
+			m.LogFunc(`Failing over to mirror[` + url + `]`)
+		}
+		req.Failover(url, info, segments)
+		return true
+	}
+	return false
+}
+
+// failedURL the url a failed attempt was talking to, empty if the error doesn't tell.
+func failedURL(err error) string {
+	var sourceErr *ihttp.SourceError
+	if errors.As(err, &sourceErr) {
+		return sourceErr.URL
+	}
+	var statusErr *ihttp.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.URL
+	}
+	var urlErr *_url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.URL
+	}
+	return ""
+}
+
+// blamedURL the url of req whose connection failed with err, the current url if the error doesn't tell.
+func blamedURL(req *ihttp.Request, err error) string {
+	if url := failedURL(err); url == req.URL || req.IsMirror(url) {
+		return url
+	}
+	return req.URL
+}
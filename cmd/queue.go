@@ -0,0 +1,571 @@
+package filedownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ihttp "github.com/sysgoblin/godownload/internal/http"
+)
+
+// long-lived queue of downloads, worked off by the download threads between Start and Close.
+
+const (
+	maxProbes              = 4   // size requests sent at once for enqueued downloads
+	defaultDownloadThreads = 3   // download threads when Config.MaxDownloadThreads is not set
+	defaultKeepFinished    = 100 // finished jobs kept when Config.KeepFinished is not set
+)
+
+// JobID identifies an enqueued Download
+type JobID int64
+
+// job a Download in the queue
+type job struct {
+	id       JobID
+	download *Download
+	host     string // name of the host of the url
+	conns    int    // connections of the running download counted for its host, guarded by FileDownloader.mu
+	priority int    // Download.Priority, changed by SetPriority. guarded by FileDownloader.mu
+	ctx      context.Context
+	cancel   context.CancelFunc
+	enqueued time.Time
+	info     *ihttp.RemoteInfo // nil until the size request is done, the job can't start before
+	progress ihttp.Progress    // bytes downloaded by every run of the job
+	limiter  *ihttp.Limiter    // bandwidth limit of the download
+	started  time.Time         // first start of the download, guarded by FileDownloader.mu
+	size     int64             // size of the complete file, guarded by FileDownloader.mu
+
+	lastWritten int64         // progress when the observer sampled it, guarded by FileDownloader.mu
+	speed       float64       // moving average of the bytes per second, guarded by FileDownloader.mu
+	result      Result        // guarded by FileDownloader.mu
+	done        chan struct{} // closed when result is final
+
+	retry       int                // retry the next run starts with, set when the run gave its thread back to wait for the host
+	stop        context.CancelFunc // stops the running download
+	interrupted bool               // the running download has been stopped by Pause, it goes back to the queue
+	pausing     bool               // the interrupted job goes back to the queue paused
+}
+
+// pool download threads started by Start or a download method, each thread takes the next job from the queue.
+type pool struct {
+	stopped      bool // guarded by FileDownloader.mu, the threads end
+	workers      int  // guarded by FileDownloader.mu, threads of this pool
+	stopObserver context.CancelFunc
+	observed     chan struct{}  // closed when the progress observer has ended
+	wg           sync.WaitGroup // download threads
+}
+
+// Start starts the download threads. Downloads which were enqueued before start now,
+// the threads keep waiting for more until Close is called.
+func (m *FileDownloader) Start() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.started = true
+	m.mu.Unlock()
+	m.start()
+}
+
+// Enqueue adds d to the queue and returns its id. It is safe to call while files are downloaded,
+// the download begins when a thread is free and Start has been called.
+func (m *FileDownloader) Enqueue(d *Download) JobID {
+	return m.enqueue(context.Background(), d).id
+}
+
+// EnqueueContext adds d to the queue like Enqueue, the download fails with the error of ctx when it is done.
+func (m *FileDownloader) EnqueueContext(ctx context.Context, d *Download) JobID {
+	return m.enqueue(ctx, d).id
+}
+
+// Wait waits until every enqueued download is done, failed or paused.
+func (m *FileDownloader) Wait() {
+	m.mu.Lock()
+	for m.active > m.paused {
+		m.idle.Wait()
+	}
+	m.mu.Unlock()
+}
+
+// Close waits for the enqueued downloads and stops the download threads.
+// Paused downloads and downloads enqueued after Close fail with ErrClosed. Call Cancel first to abort the downloads instead.
+func (m *FileDownloader) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.mu.Unlock()
+	m.start()
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+	m.Wait()
+	m.mu.Lock()
+	m.started = false
+	// their part files are kept, so a later run resumes them
+	var paused []*job
+	queue := m.queue[:0]
+	for _, j := range m.queue {
+		if j.result.State == StatePaused {
+			paused = append(paused, j)
+		} else {
+			queue = append(queue, j)
+		}
+	}
+	m.queue = queue
+	m.mu.Unlock()
+	for _, j := range paused {
+		m.finish(j, &Result{Download: j.download, State: StateFailed, Err: ErrClosed})
+	}
+	for _, j := range paused {
+		<-j.done
+	}
+	m.shutdown()
+}
+
+// SetMaxDownloadThreads changes the number of download threads, 0 or less is the default of 3.
+// When it shrinks, running downloads finish before their threads end.
+func (m *FileDownloader) SetMaxDownloadThreads(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.threads = downloadThreads(n)
+	if m.pool != nil {
+		m.addWorkers(m.pool)
+	}
+	m.ready.Broadcast()
+}
+
+// CancelDownload cancels the job, a running download stops and its download thread is free for the next job.
+// The job ends in StateCancelled, its part file is kept. Returns false if the job is unknown or finished.
+func (m *FileDownloader) CancelDownload(id JobID) bool {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	ok = ok && !isFinished(j.result.State)
+	m.mu.Unlock()
+	if ok {
+		m.LogFunc(`Download Cancelled[` + j.download.URL + `]`)
+		j.cancel()
+	}
+	return ok
+}
+
+// Pause stops the download of the job until Resume is called. A running download closes its connection,
+// its part file and resume sidecar are kept so it continues from there. Returns false if the job is unknown or finished.
+func (m *FileDownloader) Pause(id JobID) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	return ok && m.pause(j)
+}
+
+// Resume puts a paused job back in the queue. Returns false if the job is not paused.
+func (m *FileDownloader) Resume(id JobID) bool {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	ok = ok && m.resume(j)
+	m.mu.Unlock()
+	m.ready.Broadcast()
+	return ok
+}
+
+// PauseAll pauses every download, downloads enqueued afterwards are paused until ResumeAll.
+func (m *FileDownloader) PauseAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pauseAll = true
+	for _, j := range m.jobs {
+		m.pause(j)
+	}
+}
+
+// ResumeAll resumes every paused download.
+func (m *FileDownloader) ResumeAll() {
+	m.mu.Lock()
+	m.pauseAll = false
+	for _, j := range m.jobs {
+		m.resume(j)
+	}
+	m.mu.Unlock()
+	m.ready.Broadcast()
+}
+
+// pause must be called with m.mu held.
+func (m *FileDownloader) pause(j *job) bool {
+	switch j.result.State {
+	case StateQueued:
+		j.result.State = StatePaused
+		m.paused++
+		m.idle.Broadcast()
+	case StateDownloading:
+		// run puts the job back in the queue once the download has stopped.
+		j.interrupted, j.pausing = true, true
+		if j.stop != nil {
+			j.stop()
+		}
+	case StatePaused:
+	default:
+		return false
+	}
+	return true
+}
+
+// resume must be called with m.mu held.
+func (m *FileDownloader) resume(j *job) bool {
+	if m.closed {
+		return false
+	}
+	switch {
+	case j.result.State == StatePaused:
+		j.result.State = StateQueued
+		m.paused--
+	case j.result.State == StateDownloading && j.pausing:
+		j.pausing = false
+	default:
+		return false
+	}
+	return true
+}
+
+// Forget drops a finished job, Status and Stats don't report it anymore.
+// Returns false if the job is unknown or not finished.
+func (m *FileDownloader) Forget(id JobID) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok || !isFinished(j.result.State) {
+		return false
+	}
+	m.forget(j)
+	return true
+}
+
+// forget must be called with m.mu held.
+func (m *FileDownloader) forget(j *job) {
+	if m.jobs[j.id] != j {
+		// forgotten already
+		return
+	}
+	delete(m.jobs, j.id)
+	if j.info != nil && j.info.ContentLength > 0 {
+		atomic.AddInt64(&m.TotalFilesSize, -j.info.ContentLength)
+	}
+}
+
+// keepFinished adds j to the finished jobs and forgets the oldest ones beyond Config.KeepFinished, it must be called with m.mu held.
+func (m *FileDownloader) keepFinished(j *job) {
+	keep := m.Conf.KeepFinished
+	if keep == 0 {
+		keep = defaultKeepFinished
+	}
+	m.finished = append(m.finished, j)
+	for len(m.finished) > 0 && len(m.finished) > keep {
+		m.forget(m.finished[0])
+		m.finished = m.finished[1:]
+	}
+	m.pruneHosts(time.Now())
+}
+
+// isFinished reports whether a job in state s is done for good.
+func isFinished(s state) bool {
+	return s == StateDone || s == StateFailed || s == StateCancelled
+}
+
+// Status returns a copy of the result of the job, State tells whether it is queued, downloading, done or failed.
+func (m *FileDownloader) Status(id JobID) (*Result, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	r := j.result
+	return &r, true
+}
+
+func (m *FileDownloader) enqueue(ctx context.Context, d *Download) *job {
+	ctx, cancel := context.WithCancel(ctx)
+	m.mu.Lock()
+	m.lastID++
+	j := &job{
+		id:       m.lastID,
+		download: d,
+		host:     hostName(d.URL),
+		priority: d.Priority,
+		ctx:      ctx,
+		cancel:   cancel,
+		enqueued: time.Now(),
+		limiter:  ihttp.NewLimiter(d.MaxBytesPerSecond),
+		result:   Result{Download: d, State: StateQueued},
+		done:     make(chan struct{}),
+	}
+	m.jobs[j.id] = j
+	m.active++
+	m.emit(m.Conf.Hooks.OnQueued, j, nil)
+	if m.pauseAll && !m.closed {
+		j.result.State = StatePaused
+		m.paused++
+	}
+	if m.closed {
+		m.mu.Unlock()
+		m.finish(j, &Result{Download: d, State: StateFailed, Err: ErrClosed})
+		return j
+	}
+	m.queue = append(m.queue, j)
+	m.mu.Unlock()
+	go func() {
+		select {
+		case <-m.cancelled:
+			cancel()
+		case <-ctx.Done():
+		}
+		// a job cancelled while waiting doesn't need a thread to fail
+		m.dropQueued(j)
+	}()
+	go m.probe(j)
+	if m.sizeOrder() {
+		// the other jobs stop waiting for the size of j
+		time.AfterFunc(maxSizeWait, m.ready.Broadcast)
+	}
+	return j
+}
+
+// probe gets size and resume support of the file of j.
+// if the url allows head access and returns Content-Length, we can calculate progress of downloading files.
+func (m *FileDownloader) probe(j *job) {
+	m.probes <- struct{}{}
+	defer func() { <-m.probes }()
+	info := &ihttp.RemoteInfo{ContentLength: -1}
+	if m.clientErr == nil && j.ctx.Err() == nil {
+		remote, err := ihttp.GetRemoteInfo(j.ctx, m.client, j.download.URL)
+		if err != nil {
+			// the download itself tells whether the file is really unavailable.
+			m.LogFunc(fmt.Sprintf(`Could not get file info, downloading without size and resume[%s]: %v`, j.download.URL, err))
+		} else {
+			if remote.ContentLength < 0 {
+				m.LogFunc(`Unknown file size, no progress value and resume is available[` + j.download.URL + `]`)
+			}
+			info = remote
+		}
+	}
+	m.mu.Lock()
+	j.info = info
+	if info.ContentLength > 0 && m.jobs[j.id] == j {
+		atomic.AddInt64(&m.TotalFilesSize, info.ContentLength)
+	}
+	m.mu.Unlock()
+	m.ready.Broadcast()
+}
+
+// start starts the download threads unless they are running.
+func (m *FileDownloader) start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pool != nil || m.closed {
+		return
+	}
+	ctx, stopObserver := context.WithCancel(context.Background())
+	p := &pool{stopObserver: stopObserver, observed: make(chan struct{})}
+	m.pool = p
+	m.State = StateDownloading
+	// observe progress
+	m.progressObserver(ctx, p.observed)
+	m.addWorkers(p)
+}
+
+// shutdown stops the download threads, unless Start was called or a download method still uses them.
+func (m *FileDownloader) shutdown() {
+	m.mu.Lock()
+	p := m.pool
+	if p == nil || m.started || m.batches > 0 {
+		m.mu.Unlock()
+		return
+	}
+	m.pool = nil
+	m.State = StateDone
+	p.stopped = true
+	m.ready.Broadcast()
+	m.mu.Unlock()
+	p.wg.Wait()
+	p.stopObserver()
+	<-p.observed
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed && m.ProgressChan != nil {
+		close(m.ProgressChan)
+		close(m.DownloadBytesPerSecond)
+		m.ProgressChan, m.DownloadBytesPerSecond = nil, nil
+	}
+}
+
+// addWorkers starts threads until p has as many as configured, it must be called with m.mu held.
+func (m *FileDownloader) addWorkers(p *pool) {
+	for ; p.workers < m.threads; p.workers++ {
+		p.wg.Add(1)
+		go m.worker(p)
+	}
+}
+
+// worker is a download thread, it downloads one job after the other.
+func (m *FileDownloader) worker(p *pool) {
+	defer p.wg.Done()
+	for {
+		j := m.next(p)
+		if j == nil {
+			return
+		}
+		m.run(j, p)
+		m.mu.Lock()
+		m.running--
+		m.host(j.host).conns -= j.conns
+		m.pruneHosts(time.Now())
+		m.ready.Broadcast()
+		m.mu.Unlock()
+	}
+}
+
+// next takes the job from the queue which pick chooses, it waits for one until the thread is not needed anymore.
+func (m *FileDownloader) next(p *pool) *job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		if p.stopped || p.workers > m.threads {
+			p.workers--
+			return nil
+		}
+		// threads of a stopped pool may still be running
+		if m.running < m.threads {
+			if i := m.pick(time.Now()); i >= 0 {
+				j := m.queue[i]
+				m.queue = append(m.queue[:i], m.queue[i+1:]...)
+				j.result.State = StateDownloading
+				m.running++
+				h := m.host(j.host)
+				j.conns = m.conns(j)
+				h.conns += j.conns
+				m.dispatched++
+				h.served = m.dispatched
+				if j.started.IsZero() {
+					j.started = time.Now()
+				}
+				m.emit(m.Conf.Hooks.OnStart, j, nil)
+				return j
+			}
+		}
+		m.ready.Wait()
+	}
+}
+
+// downloadThreads number of download threads for the configured value n.
+func downloadThreads(n int) int {
+	if n <= 0 {
+		return defaultDownloadThreads
+	}
+	return n
+}
+
+// run downloads j on a download thread.
+func (m *FileDownloader) run(j *job, p *pool) {
+	if m.clientErr != nil {
+		m.finish(j, &Result{Download: j.download, State: StateFailed, Err: fmt.Errorf(`%w: invalid http client configuration: %w`, ErrDownload, m.clientErr)})
+		return
+	}
+	ctx, stop := context.WithCancel(j.ctx)
+	defer stop()
+	m.mu.Lock()
+	j.stop = stop
+	if j.interrupted {
+		// paused before it started
+		stop()
+	}
+	m.mu.Unlock()
+	result := m.downloadWithRetry(ctx, j)
+	// count what the runs before a pause did
+	result.Attempts, result.BytesWritten, result.Resumed = j.progress.Attempts(), j.progress.Written(), j.progress.Resumed()
+	waiting := errors.Is(result.Err, errHostWait)
+	m.mu.Lock()
+	pausedByUser := j.interrupted
+	interrupted := (j.interrupted || waiting) && result.State != StateDone && j.ctx.Err() == nil
+	j.interrupted = false
+	if interrupted {
+		j.result.Attempts, j.result.BytesWritten, j.result.Resumed = result.Attempts, result.BytesWritten, result.Resumed
+		j.result.State = StateQueued
+		if j.pausing {
+			j.result.State = StatePaused
+			m.paused++
+			m.idle.Broadcast()
+		}
+		// paused jobs keep their place in the queue
+		m.queue = append([]*job{j}, m.queue...)
+		m.mu.Unlock()
+		if pausedByUser {
+			m.LogFunc(`Download Paused[` + j.download.URL + `]`)
+		} else {
+			m.LogFunc(`Waiting for host in the queue[` + j.download.URL + `]`)
+		}
+		m.ready.Broadcast()
+		return
+	}
+	m.mu.Unlock()
+	m.finish(j, result)
+}
+
+// dropQueued fails j with the error of its context if it is still waiting for a thread.
+func (m *FileDownloader) dropQueued(j *job) {
+	m.mu.Lock()
+	for i, queued := range m.queue {
+		if queued == j {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			m.mu.Unlock()
+			m.finish(j, &Result{Download: j.download, State: StateFailed, Err: j.ctx.Err()})
+			return
+		}
+	}
+	m.mu.Unlock()
+}
+
+// finish stores the final result of j. The job counts as done once its OnComplete or OnError hook returned.
+func (m *FileDownloader) finish(j *job, result *Result) {
+	if result.State == StateFailed && errors.Is(j.ctx.Err(), context.Canceled) {
+		result.State, result.Err = StateCancelled, j.ctx.Err()
+	}
+	var size int64
+	if result.State == StateDone {
+		if info, err := os.Stat(j.download.LocalFilePath); err == nil {
+			size = info.Size()
+		}
+	}
+	j.cancel()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j.result.State == StatePaused {
+		m.paused--
+	}
+	j.result = *result
+	j.size = size
+	m.keepFinished(j)
+	hook := m.Conf.Hooks.OnError
+	if result.State == StateDone {
+		hook = m.Conf.Hooks.OnComplete
+	}
+	m.emit(hook, j, func() {
+		m.mu.Lock()
+		m.active--
+		m.idle.Broadcast()
+		m.mu.Unlock()
+		close(j.done)
+	})
+}
+
+// result returns a copy of the result of j.
+func (m *FileDownloader) result(j *job) *Result {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := j.result
+	return &r
+}
@@ -0,0 +1,177 @@
+package filedownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	ihttp "github.com/sysgoblin/godownload/internal/http"
+)
+
+// retry of failed downloads with exponential backoff.
+
+const (
+	defaultRetryWait = time.Second // wait before the first retry when Config.RetryWait is not set
+	maxRetryWait     = time.Minute // upper bound of a single backoff wait
+)
+
+// downloadWithRetry downloads the file of j and retries failed transfers up to Conf.MaxRetry times,
+// a file failing its checksum is downloaded again once even when Conf.MaxRetry is 0.
+// resumable files continue from the bytes already written by the failed attempt, or by an earlier run.
+// When the host of j has to be waited for, it returns errHostWait and the next run continues with the same retry.
+func (m *FileDownloader) downloadWithRetry(ctx context.Context, j *job) *Result {
+	d, info := j.download, j.info
+	result := &Result{Download: d, State: StateFailed}
+	connections := m.Conf.SegmentsPerFile
+	if max := m.Conf.MaxConnsPerHost; max > 0 && connections > max {
+		connections = max
+	}
+	req := &ihttp.Request{
+		URL:           d.URL,
+		LocalFilePath: d.LocalFilePath,
+		PartPath:      m.partPath(d.LocalFilePath),
+		FileSize:      info.ContentLength,
+		UseResume:     info.Resumable,
+		ETag:          info.ETag,
+		LastModified:  info.LastModified,
+		Progress:      &j.progress,
+		Limiters:      []*ihttp.Limiter{m.limiter, j.limiter},
+		Log:           m.LogFunc,
+		Client:        m.client,
+		Connections:   connections,
+	}
+	if d.Checksum != "" {
+		checksum, err := ihttp.ParseChecksum(d.Checksum)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		req.Checksum = checksum
+	}
+	ms := newMirrors(d, info)
+	if connections > 1 {
+		req.Mirrors = m.segmentMirrors(ctx, ms, d.URL)
+	}
+	first, retries := j.retry, m.Conf.MaxRetry
+	j.retry = 0
+	if first > retries {
+		// the retry of a checksum mismatch
+		retries = first
+	}
+	for attempt := first; attempt <= retries; attempt++ {
+		// the backoff of a retry which waited for its host in the queue is over
+		if attempt > first {
+			wait := retryDelay(m.Conf.RetryWait, attempt)
+			m.LogFunc(fmt.Sprintf(`Retry %d/%d of [%s] in %s`, attempt, retries, req.URL, wait))
+			if !sleepContext(ctx, wait) {
+				result.Err = ctx.Err()
+				return result
+			}
+			// every mirror gets another chance
+			ms.failed = make(map[string]bool)
+		}
+		for {
+			err := m.attempt(ctx, j, req, result, attempt, retries)
+			if errors.Is(err, errHostWait) {
+				j.retry = attempt
+				return result
+			}
+			if err == nil {
+				result.State = StateDone
+				if req.Checksum != nil {
+					result.Digest = req.Checksum.String()
+				}
+				return result
+			}
+			if ctx.Err() != nil || errors.Is(err, ihttp.ErrCancelCopy) {
+				// cancelled or timed out, retrying can't help.
+				return result
+			}
+			m.LogFunc(fmt.Sprintf(`Download attempt %d/%d failed[%s]: %v`, attempt+1, retries+1, req.URL, err))
+			if errors.Is(err, ihttp.ErrRemoteChanged) {
+				// what we knew about the file is outdated
+				if info, err := ihttp.GetRemoteInfo(ctx, m.client, req.URL); err == nil {
+					req.FileSize, req.UseResume, req.ETag, req.LastModified = info.ContentLength, info.Resumable, info.ETag, info.LastModified
+					ms.infos[req.URL] = info
+				}
+			}
+			// another mirror is tried right away
+			if !m.failover(ctx, req, ms, err) {
+				break
+			}
+		}
+		if !retryable(result.Err) {
+			m.LogFunc(`Not retrying[` + d.URL + `], the error is permanent`)
+			return result
+		}
+		if retries == 0 && errors.Is(result.Err, ihttp.ErrChecksumMismatch) {
+			// the mismatching file is deleted, it is downloaded again once even without retries
+			retries = 1
+		}
+	}
+	return result
+}
+
+// attempt downloads req of j once from its current url and adds the outcome to result.
+// attempt counts from 0 up to retries.
+func (m *FileDownloader) attempt(ctx context.Context, j *job, req *ihttp.Request, result *Result, attempt int, retries int) error {
+	if err := m.waitHost(ctx, req.URL, j.host); err != nil {
+		result.Err = err
+		return err
+	}
+	m.LogFunc(fmt.Sprintf(`Download attempt %d/%d[%s]`, attempt+1, retries+1, req.URL))
+	result.Attempts++
+	attemptCtx, stopWatch := m.watch(ctx, req.URL, req.Progress)
+	res, err := ihttp.DownloadFile(attemptCtx, req)
+	if stalled := stopWatch(); stalled != nil && err != nil && ctx.Err() == nil {
+		// the connection is aborted, the retry continues where it stopped
+		err = &ihttp.SourceError{URL: blamedURL(req, err), Err: stalled}
+	}
+	m.hostResult(ctx, blamedURL(req, err), err)
+	result.BytesWritten += res.Written
+	result.StatusCode = res.StatusCode
+	result.Err = err
+	return err
+}
+
+// retryable reports whether another attempt may succeed after err.
+// client errors are permanent, except 416 after which the local file has been reset.
+func retryable(err error) bool {
+	var statusErr *ihttp.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary() || statusErr.StatusCode == http.StatusRequestedRangeNotSatisfiable
+	}
+	return true
+}
+
+// retryDelay returns the backoff before the given retry (1 based).
+// the wait doubles on every retry and half of it is randomized, so parallel downloads don't retry in lockstep.
+func retryDelay(base time.Duration, retry int) time.Duration {
+	if base <= 0 {
+		base = defaultRetryWait
+	}
+	d := base
+	for i := 1; i < retry && d < maxRetryWait; i++ {
+		d *= 2
+	}
+	if d > maxRetryWait {
+		d = maxRetryWait
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// sleepContext waits for d and returns false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
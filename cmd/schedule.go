@@ -0,0 +1,132 @@
+package filedownloader
+
+import (
+	"time"
+
+	ihttp "github.com/sysgoblin/godownload/internal/http"
+)
+
+// order in which queued jobs get the download threads.
+
+// maxSizeWait longest wait for the size of a queued file, before a size order starts the files whose size it knows.
+const maxSizeWait = 5 * time.Second
+
+const (
+	OrderAsGiven       order = `as-given`       // OrderAsGiven starts the jobs in order of Enqueue
+	OrderSmallestFirst order = `smallest-first` // OrderSmallestFirst starts the smallest files first, files of unknown size last
+	OrderLargestFirst  order = `largest-first`  // OrderLargestFirst starts the largest files first, files of unknown size last
+	OrderPriority      order = `priority`       // OrderPriority starts the jobs with the highest Download.Priority first
+)
+
+type order string
+
+// SetPriority changes the priority of a queued or paused job, with OrderPriority a higher one starts earlier.
+// Returns false if the job is unknown or not waiting anymore.
+func (m *FileDownloader) SetPriority(id JobID, priority int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok || (j.result.State != StateQueued && j.result.State != StatePaused) {
+		return false
+	}
+	j.priority = priority
+	m.ready.Broadcast()
+	return true
+}
+
+// pick must be called with m.mu held. It returns the position in m.queue of the job to start next, -1 if none may start.
+// the job which comes first in Config.Order starts, on a tie hosts take turns: the one which started a download
+// least recently goes first. a job whose size request is not done yet holds back the later jobs of its host,
+// and with a size order every job for up to maxSizeWait. so does a job which needs more connections than its host
+// has free, the connections it needs become free instead of being taken by smaller downloads.
+func (m *FileDownloader) pick(now time.Time) int {
+	candidates := make(map[string]int) // position of the best job of each host
+	held := make(map[string]bool)      // hosts whose later jobs can't start
+	for i, j := range m.queue {
+		if j.result.State != StateQueued {
+			continue
+		}
+		if j.info == nil && m.sizeOrder() && now.Sub(j.enqueued) < maxSizeWait {
+			// the file may come before every file whose size is known
+			return -1
+		}
+		if held[j.host] {
+			continue
+		}
+		if j.info == nil {
+			held[j.host] = true
+			continue
+		}
+		h := m.host(j.host)
+		if h.wait(now) != 0 || h.open && h.conns > 0 {
+			// held back by Retry-After or the breaker, an open breaker gets a single download to probe the host
+			held[j.host] = true
+			continue
+		}
+		if !m.hasRoom(h, m.conns(j)) {
+			// more connections than MaxConnsPerHost allows right now
+			held[j.host] = true
+			continue
+		}
+		if c, ok := candidates[j.host]; !ok || m.before(j, m.queue[c]) {
+			candidates[j.host] = i
+		}
+	}
+	best := -1
+	for _, i := range candidates {
+		if best < 0 || m.startsBefore(i, best) {
+			best = i
+		}
+	}
+	return best
+}
+
+// sizeOrder reports whether Config.Order ranks the jobs by the size of their files.
+func (m *FileDownloader) sizeOrder() bool {
+	return m.Conf.Order == OrderSmallestFirst || m.Conf.Order == OrderLargestFirst
+}
+
+// startsBefore reports whether the candidate at position i of m.queue starts before the one at position k.
+func (m *FileDownloader) startsBefore(i, k int) bool {
+	a, b := m.queue[i], m.queue[k]
+	if m.before(a, b) || m.before(b, a) {
+		return m.before(a, b)
+	}
+	if sa, sb := m.hosts[a.host].served, m.hosts[b.host].served; sa != sb {
+		return sa < sb
+	}
+	return i < k
+}
+
+// before reports whether a comes before b in Config.Order, false for jobs of the same rank.
+func (m *FileDownloader) before(a, b *job) bool {
+	sa, sb := a.info.ContentLength, b.info.ContentLength
+	switch m.Conf.Order {
+	case OrderSmallestFirst:
+		return sa >= 0 && (sb < 0 || sa < sb)
+	case OrderLargestFirst:
+		return sa >= 0 && (sb < 0 || sa > sb)
+	case OrderPriority:
+		return a.priority > b.priority
+	}
+	return false
+}
+
+// conns number of connections j downloads with, it must be called with m.mu held.
+func (m *FileDownloader) conns(j *job) int {
+	n := 1
+	if j.info.Resumable && j.info.ContentLength > 0 && m.Conf.SegmentsPerFile > 1 {
+		// small files get fewer segments
+		n = ihttp.Segments(j.info.ContentLength, m.Conf.SegmentsPerFile)
+	}
+	if max := m.Conf.MaxConnsPerHost; max > 0 && n > max {
+		n = max
+	}
+	return n
+}
+
+// hasRoom reports whether h has n free connections of Config.MaxConnsPerHost, a host without downloads always has.
+func (m *FileDownloader) hasRoom(h *host, n int) bool {
+	max := m.Conf.MaxConnsPerHost
+	return max <= 0 || h.conns == 0 || h.conns+n <= max
+}
@@ -0,0 +1,174 @@
+package filedownloader
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// snapshots of the progress of the downloads.
+
+const (
+	progressInterval = time.Second // how often the progress observer samples the downloads
+	speedSmoothing   = 0.3         // weight of the last interval in the moving average of the speed
+)
+
+// FileStats progress of a single download
+type FileStats struct {
+	ID          JobID
+	Download    *Download
+	State       state
+	Done        int64         // bytes of the file on disk, the resumed ones included
+	Resumed     int64         // verified bytes of an earlier run the download continued from
+	Total       int64         // size of the file, -1 if unknown
+	Speed       float64       // bytes per second, a moving average over the last seconds
+	ETA         time.Duration // time until the file is complete at the current speed, -1 if unknown
+	Attempts    int           // download attempts including retries
+	Connections int           // connections receiving the file right now
+}
+
+// Stats progress of all downloads of a FileDownloader
+type Stats struct {
+	Files       []FileStats // unfinished and the last Config.KeepFinished finished downloads, in order of Enqueue
+	Done        int64       // bytes of all files on disk
+	Resumed     int64       // bytes of all files which were resumed instead of downloaded
+	Total       int64       // size of all files whose size is known
+	Speed       float64     // bytes per second of all downloads
+	ETA         time.Duration
+	Active      int // downloads running right now
+	Connections int
+}
+
+// Stats returns the current progress of the downloads. Speeds are updated every second while files are downloaded.
+func (m *FileDownloader) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats()
+}
+
+// Subscribe returns a channel which receives Stats every second while files are downloaded.
+// The channel holds only the latest Stats, a slow reader misses some but never stalls a download.
+// The returned function ends the subscription and closes the channel.
+func (m *FileDownloader) Subscribe() (<-chan Stats, func()) {
+	ch := make(chan Stats, 1)
+	m.mu.Lock()
+	if m.subs == nil {
+		m.subs = make(map[chan Stats]struct{})
+	}
+	m.subs[ch] = struct{}{}
+	m.mu.Unlock()
+	var unsubscribed bool
+	return ch, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if !unsubscribed {
+			unsubscribed = true
+			delete(m.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// sample updates the speeds from the bytes downloaded during elapsed, and publishes the Stats to the subscribers.
+// It returns them and the bytes downloaded during elapsed.
+func (m *FileDownloader) sample(elapsed time.Duration) (Stats, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var downloaded int64
+	for _, j := range m.jobs {
+		written := j.progress.Written()
+		sub := written - j.lastWritten
+		j.lastWritten = written
+		downloaded += sub
+		if j.result.State != StateDownloading {
+			j.speed = 0
+			continue
+		}
+		rate := float64(sub) / elapsed.Seconds()
+		if j.speed == 0 {
+			j.speed = rate
+		} else {
+			j.speed = speedSmoothing*rate + (1-speedSmoothing)*j.speed
+		}
+	}
+	for _, j := range m.ordered() {
+		if j.result.State == StateDownloading {
+			m.emit(m.Conf.Hooks.OnProgress, j, nil)
+		}
+	}
+	stats := m.stats()
+	for ch := range m.subs {
+		// replace a snapshot nobody has read yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- stats
+	}
+	return stats, downloaded
+}
+
+// stats must be called with m.mu held.
+func (m *FileDownloader) stats() Stats {
+	stats := Stats{Files: make([]FileStats, 0, len(m.jobs))}
+	var remaining int64
+	for _, j := range m.ordered() {
+		f := FileStats{
+			ID:          j.id,
+			Download:    j.download,
+			State:       j.result.State,
+			Done:        j.progress.Done(),
+			Resumed:     j.progress.Resumed(),
+			Total:       -1,
+			Speed:       j.speed,
+			ETA:         -1,
+			Attempts:    j.progress.Attempts(),
+			Connections: j.progress.Connections(),
+		}
+		if j.info != nil {
+			f.Total = j.info.ContentLength
+		}
+		if f.Total >= 0 && f.State != StateDone && f.State != StateFailed && f.State != StateCancelled {
+			left := f.Total - f.Done
+			if left < 0 {
+				left = 0
+			}
+			remaining += left
+			f.ETA = eta(left, f.Speed)
+		}
+		stats.Files = append(stats.Files, f)
+		stats.Done += f.Done
+		stats.Resumed += f.Resumed
+		if f.Total > 0 {
+			stats.Total += f.Total
+		}
+		stats.Speed += f.Speed
+		stats.Connections += f.Connections
+		if f.State == StateDownloading {
+			stats.Active++
+		}
+	}
+	stats.ETA = eta(remaining, stats.Speed)
+	return stats
+}
+
+// ordered returns the jobs in order of Enqueue, it must be called with m.mu held.
+func (m *FileDownloader) ordered() []*job {
+	jobs := make([]*job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].id < jobs[b].id })
+	return jobs
+}
+
+// eta time to download left bytes at speed, -1 if it can't be told.
+func eta(left int64, speed float64) time.Duration {
+	if left == 0 {
+		return 0
+	}
+	if speed <= 0 {
+		return -1
+	}
+	return time.Duration(math.Ceil(float64(left) / speed * float64(time.Second)))
+}
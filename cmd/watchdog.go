@@ -0,0 +1,96 @@
+package filedownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ihttp "github.com/sysgoblin/godownload/internal/http"
+)
+
+// watchdog of a download attempt, it aborts a connection which hangs or crawls so the retry reconnects and resumes.
+
+const (
+	maxWatchInterval      = time.Second      // longest time between two checks of the watchdog
+	defaultMinSpeedPeriod = 30 * time.Second // period of Config.MinSpeed when Config.MinSpeedPeriod is not set
+)
+
+// sample bytes written at a time
+type sample struct {
+	at      time.Time
+	written int64
+}
+
+// watch returns the context of an attempt, it is cancelled when the attempt receives no bytes for Config.StallTimeout
+// or less than Config.MinSpeed over Config.MinSpeedPeriod. The returned function stops watching,
+// it returns an error wrapping ErrStalled if the watchdog aborted the attempt.
+func (m *FileDownloader) watch(ctx context.Context, url string, progress *ihttp.Progress) (context.Context, func() error) {
+	stall, minSpeed, period := m.Conf.StallTimeout, m.Conf.MinSpeed, m.Conf.MinSpeedPeriod
+	if period <= 0 {
+		period = defaultMinSpeedPeriod
+	}
+	if stall <= 0 && minSpeed <= 0 {
+		return ctx, func() error { return nil }
+	}
+	interval := maxWatchInterval
+	if stall > 0 && stall/4 < interval {
+		interval = stall / 4
+	}
+	if minSpeed > 0 && period/4 < interval {
+		interval = period / 4
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		start := time.Now()
+		last := sample{at: start, written: progress.Written()}
+		samples := []sample{last}
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				written := progress.Written()
+				if written != last.written {
+					last = sample{at: now, written: written}
+				}
+				samples = append(samples, sample{at: now, written: written})
+				// keep the newest sample which is at least a period old
+				for len(samples) > 1 && now.Sub(samples[1].at) >= period {
+					samples = samples[1:]
+				}
+				var err error
+				if idle := now.Sub(last.at); stall > 0 && idle >= stall {
+					err = fmt.Errorf(`%w: no bytes received for %s`, ErrStalled, idle.Round(time.Millisecond))
+				} else if oldest := samples[0]; minSpeed > 0 && now.Sub(oldest.at) >= period {
+					speed := float64(written-oldest.written) / now.Sub(oldest.at).Seconds()
+					if speed < float64(minSpeed) {
+						err = fmt.Errorf(`%w: %.0f bytes per second over %s, below %d`, ErrStalled, speed, period, minSpeed)
+					}
+				}
+				if err != nil {
+					m.LogFunc(fmt.Sprintf(`Download stalled, reconnecting[%s]: %v`, url, err))
+					cancel(err)
+					return
+				}
+			}
+		}
+	}()
+	return ctx, func() error {
+		close(done)
+		<-watched
+		err := context.Cause(ctx)
+		cancel(nil)
+		if errors.Is(err, ErrStalled) {
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,166 @@
+package internalhttp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// checksum verification of downloaded files. the digest is computed while the file is written,
+// only bytes that were not streamed in order (resumed prefix, later segments) are read back from disk.
+
+var ErrChecksumMismatch = errors.New(`checksum mismatch`) // ErrChecksumMismatch downloaded file doesn't have the expected digest
+
+// hash constructors by algorithm name of a checksum
+var checksumAlgorithms = map[string]func() hash.Hash{
+	`md5`:    md5.New,
+	`sha256`: sha256.New,
+	`sha512`: sha512.New,
+	`blake2b`: func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+	`blake2b-256`: func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	},
+	`blake2b-512`: func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+}
+
+// Checksum expected digest of a file, written as `algorithm:hex` like `sha256:9f86d0...`.
+type Checksum struct {
+	Algorithm string
+	Sum       []byte
+}
+
+// ParseChecksum parses `algorithm:hex`, algorithm is one of md5, sha256, sha512, blake2b (512 bit), blake2b-256 and blake2b-512.
+func ParseChecksum(value string) (*Checksum, error) {
+	algorithm, digest, ok := strings.Cut(value, `:`)
+	if !ok {
+		return nil, fmt.Errorf(`checksum %q is not in algorithm:hex form`, value)
+	}
+	algorithm = strings.ToLower(algorithm)
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf(`unsupported checksum algorithm %q`, algorithm)
+	}
+	sum, err := hex.DecodeString(digest)
+	if err != nil {
+		return nil, fmt.Errorf(`checksum %q is not hex: %w`, value, err)
+	}
+	if size := newHash().Size(); len(sum) != size {
+		return nil, fmt.Errorf(`checksum %q has %d bytes, %s needs %d`, value, len(sum), algorithm, size)
+	}
+	return &Checksum{Algorithm: algorithm, Sum: sum}, nil
+}
+
+func (c *Checksum) String() string {
+	return c.Algorithm + `:` + hex.EncodeToString(c.Sum)
+}
+
+// ChecksumError is returned when the downloaded file doesn't have the expected digest.
+type ChecksumError struct {
+	Expected *Checksum
+	Actual   *Checksum
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf(`%s: expected %s, got %s`, ErrChecksumMismatch, e.Expected, e.Actual)
+}
+
+// Is makes every ChecksumError match ErrChecksumMismatch.
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// fileHasher hashes the contiguous prefix of a file as it is written.
+type fileHasher struct {
+	hash   hash.Hash
+	hashed int64 // bytes of the file hashed so far
+}
+
+// write hashes b if it continues the hashed prefix.
+func (h *fileHasher) write(pos int64, b []byte) {
+	if pos == h.hashed {
+		h.hash.Write(b)
+		h.hashed += int64(len(b))
+	}
+}
+
+// catchUp hashes the file from the hashed prefix up to size from disk.
+func (h *fileHasher) catchUp(file *os.File, size int64) error {
+	if h.hashed >= size {
+		return nil
+	}
+	n, err := io.Copy(h.hash, io.NewSectionReader(file, h.hashed, size-h.hashed))
+	h.hashed += n
+	return err
+}
+
+func (h *fileHasher) reset() {
+	h.hash.Reset()
+	h.hashed = 0
+}
+
+// hashWritten feeds written bytes of the part file to the checksum.
+func (r *Request) hashWritten(pos int64, b []byte) {
+	if r.hasher == nil {
+		return
+	}
+	r.hashMu.Lock()
+	r.hasher.write(pos, b)
+	r.hashMu.Unlock()
+}
+
+// resetHash starts the checksum over, when the bytes on disk are thrown away.
+func (r *Request) resetHash() {
+	if r.hasher == nil {
+		return
+	}
+	r.hashMu.Lock()
+	r.hasher.reset()
+	r.hashMu.Unlock()
+}
+
+// rehashPrefix hashes what the first segment has written by an earlier run, before new bytes are streamed.
+func (r *Request) rehashPrefix(file *os.File) error {
+	if r.hasher == nil {
+		return nil
+	}
+	r.plan.mu.Lock()
+	prefix := r.plan.Segments[0].Done
+	r.plan.mu.Unlock()
+	r.hashMu.Lock()
+	defer r.hashMu.Unlock()
+	return r.hasher.catchUp(file, prefix)
+}
+
+// verifyChecksum completes the digest of the file and compares it with the expected one.
+func (r *Request) verifyChecksum(file *os.File, size int64) error {
+	if r.Checksum == nil {
+		return nil
+	}
+	r.hashMu.Lock()
+	defer r.hashMu.Unlock()
+	if err := r.hasher.catchUp(file, size); err != nil {
+		return &WriteError{Err: err}
+	}
+	actual := &Checksum{Algorithm: r.Checksum.Algorithm, Sum: r.hasher.hash.Sum(nil)}
+	if !bytes.Equal(actual.Sum, r.Checksum.Sum) {
+		return &ChecksumError{Expected: r.Checksum, Actual: actual}
+	}
+	return nil
+}
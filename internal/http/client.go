@@ -0,0 +1,57 @@
+package internalhttp
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	_url "net/url"
+	"time"
+)
+
+// http client of a downloader, every downloader owns its transport so settings never leak into http.DefaultClient.
+
+// ClientOptions settings of the transport built by NewClient.
+type ClientOptions struct {
+	Proxy                 string        // proxy url like socks5://127.0.0.1:9050, default is the proxy of the environment
+	ConnectTimeout        time.Duration // timeout of establishing a connection, 0 is the net/http default
+	ResponseHeaderTimeout time.Duration // timeout of waiting for response headers after sending a request, 0 is none
+	TLSClientConfig       *tls.Config   // tls settings like custom root CAs
+	MaxConnsPerHost       int           // limit of connections to a single host, 0 is no limit
+}
+
+// NewTransport builds a transport from the net/http default one with opts applied.
+func NewTransport(opts ClientOptions) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.Proxy != "" {
+		proxyURL, err := _url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if opts.ConnectTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: opts.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	if opts.TLSClientConfig != nil {
+		transport.TLSClientConfig = opts.TLSClientConfig.Clone()
+	}
+	transport.MaxConnsPerHost = opts.MaxConnsPerHost
+	if opts.MaxConnsPerHost > transport.MaxIdleConnsPerHost {
+		// keep connections of parallel segments alive between requests
+		transport.MaxIdleConnsPerHost = opts.MaxConnsPerHost
+	}
+	return transport, nil
+}
+
+// NewClient builds a client on transport, or on a transport from opts if it is nil.
+func NewClient(transport http.RoundTripper, opts ClientOptions) (*http.Client, error) {
+	if transport == nil {
+		t, err := NewTransport(opts)
+		if err != nil {
+			return nil, err
+		}
+		transport = t
+	}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,142 @@
+package internalhttp
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	_url "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// typed errors of a download attempt, callers check them with errors.Is and errors.As.
+
+const maxRetryAfter = time.Hour // longest wait of Retry-After which is honoured
+
+var (
+	ErrNotFound            = errors.New(`file not found on server`)               // ErrNotFound server answered 404 or 410
+	ErrRangeNotSatisfiable = errors.New(`requested range not satisfiable`)        // ErrRangeNotSatisfiable server answered 416 to a resume request
+	ErrShortBody           = errors.New(`response body is shorter than expected`) // ErrShortBody connection ended before the whole file arrived
+	ErrWrite               = errors.New(`could not write to local file`)          // ErrWrite downloaded bytes could not be stored
+	ErrContentRange        = errors.New(`invalid Content-Range in response`)      // ErrContentRange 206 response doesn't fit the requested range
+	ErrRemoteChanged       = errors.New(`file changed on server`)                 // ErrRemoteChanged server sent a different file than the ranges already downloaded belong to
+)
+
+// StatusError is returned when the server answered with an http status that is not a successful download,
+// 200 for a full download and 206 for a resumed one.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	RetryAfter time.Duration // wait the server asked for with Retry-After on 429 and 503, 0 if none
+}
+
+// statusError returns the StatusError of resp.
+func statusError(url string, resp *http.Response) *StatusError {
+	e := &StatusError{URL: url, StatusCode: resp.StatusCode}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		e.RetryAfter, _ = ParseRetryAfter(resp.Header.Get(`Retry-After`), time.Now())
+	}
+	return e
+}
+
+// ParseRetryAfter parses a Retry-After header, either seconds or an http date, into the wait from now.
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		if seconds > int64(maxRetryAfter/time.Second) {
+			return maxRetryAfter, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	wait := date.Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait, true
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf(`unexpected http status %d %s[%s]`, e.StatusCode, http.StatusText(e.StatusCode), e.URL)
+}
+
+// Is reports the sentinel error matching the status code.
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone
+	case ErrRangeNotSatisfiable:
+		return e.StatusCode == http.StatusRequestedRangeNotSatisfiable
+	}
+	return false
+}
+
+// ClientError reports a 4xx status, the request itself was refused and repeating it as is won't help.
+func (e *StatusError) ClientError() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// ServerError reports a 5xx status.
+func (e *StatusError) ServerError() bool {
+	return e.StatusCode >= 500 && e.StatusCode < 600
+}
+
+// Temporary reports whether the same request may succeed later.
+func (e *StatusError) Temporary() bool {
+	return e.ServerError() || e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests
+}
+
+// SourceError is returned when a connection to one of the urls of a download failed, URL tells which one.
+type SourceError struct {
+	URL string
+	Err error
+}
+
+func (e *SourceError) Error() string {
+	return e.Err.Error() + `[` + e.URL + `]`
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// sourceError wraps err of a connection to url, unless err tells the url already.
+func sourceError(url string, err error) error {
+	var statusErr *StatusError
+	var urlErr *_url.Error
+	if err == nil || errors.As(err, &statusErr) || errors.As(err, &urlErr) {
+		return err
+	}
+	return &SourceError{URL: url, Err: err}
+}
+
+// WriteError is returned when the local file could not be created or written.
+type WriteError struct {
+	Err error
+}
+
+func (e *WriteError) Error() string {
+	return ErrWrite.Error() + `: ` + e.Err.Error()
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes every WriteError match ErrWrite.
+func (e *WriteError) Is(target error) bool {
+	return target == ErrWrite
+}
@@ -0,0 +1,88 @@
+package internalhttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// downloaded files are written to a part file and only moved to their local path when complete,
+// so nobody watching the directory picks up a half written file.
+
+func (r *Request) partPath() string {
+	if r.PartPath != "" {
+		return r.PartPath
+	}
+	return r.LocalFilePath + DefaultPartSuffix
+}
+
+// finish checks the size and checksum of the complete part file, syncs it and moves it to LocalFilePath.
+// size is the expected size, -1 if unknown.
+func (r *Request) finish(file *os.File, size int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return &WriteError{Err: err}
+	}
+	if size >= 0 && info.Size() != size {
+		return fmt.Errorf(`%w: part file has %d of %d bytes[%s]`, ErrShortBody, info.Size(), size, r.partPath())
+	}
+	if err := r.verifyChecksum(file, info.Size()); err != nil {
+		r.Log(`Deleting downloaded file[`+r.partPath()+`]:`, err)
+		r.discard(file)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return &WriteError{Err: err}
+	}
+	if err := file.Close(); err != nil {
+		return &WriteError{Err: err}
+	}
+	if err := moveFile(r.partPath(), r.LocalFilePath); err != nil {
+		return &WriteError{Err: err}
+	}
+	r.removeMeta()
+	return nil
+}
+
+// moveFile atomically renames src to dst. when they are on different file systems, src is copied
+// next to dst first so that the final rename is still atomic.
+func moveFile(src string, dst string) error {
+	err := os.Rename(src, dst)
+	var linkErr *os.LinkError
+	if err == nil || !errors.As(err, &linkErr) {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dst), `.`+filepath.Base(dst)+DefaultPartSuffix)
+	if err := copyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -6,124 +6,293 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	_url "net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // file downloading methods using http libraries.
 
 const acceptRangeHeader = "Accept-Ranges"
 
+const DefaultPartSuffix = `.part` // DefaultPartSuffix appended to the local file path while downloading
+
 var (
-	downloadError  DownloadError = `downloadError`
-	cancelError    DownloadError = `cancelDownloadError`
-	ErrCancelCopy                = errors.New(`cancelled by context`) // ErrCancelCopy Error occur by cancel
-	copyBufferSize               = 32 * 1024
+	ErrCancelCopy  = errors.New(`cancelled by context`) // ErrCancelCopy Error occur by cancel
+	copyBufferSize = 32 * 1024
 )
 
-// DownloadError is a string used for context value key.
-type DownloadError string
+// Result what a single download attempt has done.
+type Result struct {
+	StatusCode int   // http status of the response, 0 if no response was received
+	Written    int64 // bytes written to the local file by this attempt
+}
+
+// RemoteInfo what the server tells about a file before downloading it.
+type RemoteInfo struct {
+	ContentLength int64  // whole size of the file, -1 if unknown
+	Resumable     bool   // server accepts Range requests
+	ETag          string // validators of the file, used as If-Range on resume
+	LastModified  string
+}
+
+// Request download of URL into LocalFilePath. the same Request is passed to every attempt,
+// it keeps the progress of the segments so a retry continues where the last attempt stopped.
+type Request struct {
+	URL           string
+	LocalFilePath string                     // where the file is moved once it is complete
+	PartPath      string                     // where the file is written while downloading, default is LocalFilePath with DefaultPartSuffix
+	FileSize      int64                      // whole size of the file from RemoteInfo, -1 if unknown
+	UseResume     bool                       // server accepts ranges, the download is resumable and can be split into segments
+	Connections   int                        // download the file in segments over this many connections at once
+	ETag          string                     // sent as If-Range, so a file changed on the server is downloaded again from the start
+	LastModified  string                     // sent as If-Range when there is no strong ETag
+	Checksum      *Checksum                  // expected digest, a mismatching file is deleted
+	Progress      *Progress                  // counts the bytes written by every attempt
+	Limiters      []*Limiter                 // bandwidth limits the connections share, nil ones don't limit
+	Mirrors       []string                   // further urls of the same length and validators, segments are requested from URL and Mirrors in turn
+	Log           func(param ...interface{}) // logging function
+	Client        *http.Client               // client of the downloader, default is http.DefaultClient
+
+	plan     *SegmentPlan // progress of the segments, loaded from the resume sidecar on the first attempt
+	saveMu   sync.Mutex
+	lastSave time.Time
+	hasher   *fileHasher // digest of the part file for Checksum
+	hashMu   sync.Mutex
+}
 
 // getting url's head information, mostly for getting file size from Content-Length.
-func getHead(url string, proxy string) (*http.Response, error) {
-	// set the proxy for the request
-	if proxy != "" {
-		proxyURL, err := _url.Parse(proxy)
-		if err != nil {
-			return nil, err
-		}
-		http.DefaultClient.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+func getHead(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(ctx, `HEAD`, url, nil)
+	if err != nil {
+		return nil, err
 	}
-	resp, err := http.Head(url)
+	resp, err := client.Do(r)
 	if err != nil {
 		return nil, err
 	}
+	resp.Body.Close()
 	return resp, nil
 }
 
-// get content-length from header
-func GetFileSizeAndResumable(url string, proxy string) (int64, bool, error) {
-	resp, err := getHead(url, proxy)
+// getFirstByte requests only the first byte of url, for servers which refuse HEAD or don't send a length with it.
+// Content-Range of the answer tells the size.
+func getFirstByte(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(ctx, `GET`, url, nil)
 	if err != nil {
-		return 0, false, err
+		return nil, err
 	}
-	var acceptResume bool
-	if resp.Header.Get(acceptRangeHeader) == "" {
-		acceptResume = false
-	} else {
-		acceptResume = true
+	r.Header.Set(`Range`, `bytes=0-0`)
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, err
 	}
-	return resp.ContentLength, acceptResume, nil
+	// a server ignoring the range sends the whole file, which is not read here.
+	resp.Body.Close()
+	return resp, nil
 }
 
-// Download Single File
-func DownloadFile(ctx context.Context, url string, localFilePath string, downloadedBytes chan int, useResume bool, filesize int64, log func(param ...interface{}), proxy string) {
-	// if proxy has been provided we need to set the client transport for the http client
-	if proxy != "" {
-		proxyURL, err := _url.Parse(proxy)
-		if err != nil {
-			ctx = context.WithValue(ctx, downloadError, err)
-			return
+// GetRemoteInfo get size, range support and validators of url from its head. When HEAD fails or has no
+// Content-Length, the first byte is requested instead. ContentLength is -1 if the size can't be known.
+func GetRemoteInfo(ctx context.Context, client *http.Client, url string) (*RemoteInfo, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := getHead(ctx, client, url)
+	if err == nil && resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 {
+		acceptRanges := resp.Header.Get(acceptRangeHeader)
+		return &RemoteInfo{
+			ContentLength: resp.ContentLength,
+			Resumable:     acceptRanges != "" && acceptRanges != `none`,
+			ETag:          resp.Header.Get(`ETag`),
+			LastModified:  resp.Header.Get(`Last-Modified`),
+		}, nil
+	}
+	headErr := err
+	if headErr == nil {
+		headErr = statusError(url, resp)
+		if resp.StatusCode == http.StatusOK {
+			headErr = fmt.Errorf(`no Content-Length in head[%s]`, url)
 		}
-		http.DefaultClient.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
 	}
+	resp, err = getFirstByte(ctx, client, url)
+	if err != nil {
+		return nil, fmt.Errorf(`head: %w, range probe: %w`, headErr, err)
+	}
+	info := &RemoteInfo{
+		ContentLength: -1,
+		ETag:          resp.Header.Get(`ETag`),
+		LastModified:  resp.Header.Get(`Last-Modified`),
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if _, _, total, err := parseContentRange(resp.Header.Get(`Content-Range`)); err == nil {
+			info.ContentLength = total
+			info.Resumable = total > 0
+		}
+	case http.StatusOK:
+		info.ContentLength = resp.ContentLength
+	default:
+		return nil, fmt.Errorf(`head: %w, range probe: %w`, headErr, statusError(url, resp))
+	}
+	return info, nil
+}
+
+// get content-length from header
+func GetFileSizeAndResumable(ctx context.Context, client *http.Client, url string) (int64, bool, error) {
+	info, err := GetRemoteInfo(ctx, client, url)
+	if err != nil {
+		return 0, false, err
+	}
+	return info.ContentLength, info.Resumable, nil
+}
 
+// Download Single File. Each call is one attempt; a resumable file continues from the bytes
+// the previous attempts or runs have written to its part file.
+func DownloadFile(ctx context.Context, req *Request) (Result, error) {
 	select {
 	case <-ctx.Done():
-		log(`Download Cancelled by context`)
-		return
+		req.Log(`Download Cancelled by context`)
+		return Result{}, ErrCancelCopy
 	default:
-		file, offset, err := setupDownloadFile(localFilePath, useResume)
-		if err != nil {
-			return
-		}
-		defer file.Close()
-		r, err := http.NewRequestWithContext(ctx, `GET`, url, nil)
-		if useResume {
-			r.Header.Add(`Range`, rangeHeaderValue(file, offset, filesize))
-			log(`Resume enabled, added download header::`, r.Header)
+		req.Progress.addAttempt()
+		if req.Checksum != nil && req.hasher == nil {
+			req.hasher = &fileHasher{hash: checksumAlgorithms[req.Checksum.Algorithm]()}
 		}
-		if err != nil {
-			return
+		if !req.UseResume || req.FileSize <= 0 {
+			// nothing to resume from, a sidecar left behind belongs to an older version of the file
+			req.removeMeta()
+			return downloadStream(ctx, req)
 		}
-		// download file
-		resp, err := http.DefaultClient.Do(r)
-		if err != nil {
-			ctx = context.WithValue(ctx, downloadError, err)
-			return
+		if req.plan == nil {
+			req.prepare()
 		}
-		defer resp.Body.Close()
-		readSource := &responseReader{Reader: resp.Body, readBytes: downloadedBytes}
-		_, err = copyBuffer(ctx, file, readSource, nil)
-		if err != nil {
-			if err == ErrCancelCopy {
-				ctx = context.WithValue(ctx, cancelError, err)
-				log(`Download File Cancelled[` + url + `]`)
-			} else {
-				ctx = context.WithValue(ctx, downloadError, err)
-			}
-			return
+		return downloadSegments(ctx, req)
+	}
+}
+
+// downloadStream downloads a file which can't be resumed from the start in a single request.
+func downloadStream(ctx context.Context, req *Request) (Result, error) {
+	var result Result
+	url := req.URL
+	file, err := os.Create(req.partPath())
+	if err != nil {
+		return result, &WriteError{Err: err}
+	}
+	defer file.Close()
+	req.Progress.seed(0)
+	r, err := http.NewRequestWithContext(ctx, `GET`, url, nil)
+	if err != nil {
+		return result, err
+	}
+	// download file
+	resp, err := req.client().Do(r)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	req.Progress.addConn(1)
+	defer req.Progress.addConn(-1)
+	result.StatusCode = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		// never keep an error page.
+		file.Close()
+		os.Remove(req.partPath())
+		return result, statusError(url, resp)
+	}
+	req.resetHash()
+	result.Written, err = copyBuffer(ctx, &streamWriter{file: file, req: req}, resp.Body, nil, req.Limiters)
+	if err != nil {
+		if err == ErrCancelCopy {
+			req.Log(`Download File Cancelled[` + url + `]`)
+		} else if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = fmt.Errorf(`%w: %w`, ErrShortBody, err)
 		}
+		return result, err
+	}
+	if total := resp.ContentLength; total > 0 && result.Written < total {
+		return result, fmt.Errorf(`%w: got %d of %d bytes[%s]`, ErrShortBody, result.Written, total, url)
 	}
-	log(`Download File Done[` + url + `]`)
+	if err := req.finish(file, resp.ContentLength); err != nil {
+		return result, err
+	}
+	req.Log(`Download File Done[` + url + `]`)
+	return result, nil
 }
 
-// responseReader http response reader with channels
-type responseReader struct {
-	io.Reader
-	readBytes chan int // send read bytes to channel
+func (r *Request) client() *http.Client {
+	if r.Client == nil {
+		return http.DefaultClient
+	}
+	return r.Client
 }
 
-func (m *responseReader) Read(p []byte) (int, error) {
-	n, err := m.Reader.Read(p)
-	m.readBytes <- n
+// streamWriter writes a file from the start and feeds the checksum.
+type streamWriter struct {
+	file *os.File
+	req  *Request
+	pos  int64
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	n, err := w.file.Write(b)
+	w.req.hashWritten(w.pos, b[:n])
+	w.req.Progress.add(n)
+	w.pos += int64(n)
 	return n, err
 }
 
+// checkContentRange validates Content-Range of a 206 response against the requested range start and the file size.
+func checkContentRange(value string, begin int64, fileSize int64) error {
+	start, _, total, err := parseContentRange(value)
+	if err != nil {
+		return err
+	}
+	if start != begin {
+		return fmt.Errorf(`%w: %q does not start at requested offset %d`, ErrContentRange, value, begin)
+	}
+	if total >= 0 && total != fileSize {
+		return fmt.Errorf(`%w: %q does not match file size %d`, ErrContentRange, value, fileSize)
+	}
+	return nil
+}
+
+// parseContentRange parses `bytes start-end/total`, total is -1 when it is `*`.
+func parseContentRange(value string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(value, `bytes `)
+	if !ok {
+		return 0, 0, 0, fmt.Errorf(`%w: %q`, ErrContentRange, value)
+	}
+	rng, size, ok := strings.Cut(spec, `/`)
+	if !ok {
+		return 0, 0, 0, fmt.Errorf(`%w: %q`, ErrContentRange, value)
+	}
+	first, last, ok := strings.Cut(rng, `-`)
+	if !ok {
+		return 0, 0, 0, fmt.Errorf(`%w: %q`, ErrContentRange, value)
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf(`%w: %q`, ErrContentRange, value)
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+		return 0, 0, 0, fmt.Errorf(`%w: %q`, ErrContentRange, value)
+	}
+	total = -1
+	if size != `*` {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil || total <= end {
+			return 0, 0, 0, fmt.Errorf(`%w: %q`, ErrContentRange, value)
+		}
+	}
+	return start, end, total, nil
+}
+
 // file download takes time if the file size was large.
 // so instead of using io package copy, I made simple cancellable copy method.
 
-func copyBuffer(ctx context.Context, dst io.Writer, src io.Reader, buf []byte) (written int64, err error) {
+// limits are waited for after every read, reads are small enough to keep slow limits smooth.
+func copyBuffer(ctx context.Context, dst io.Writer, src io.Reader, buf []byte, limits []*Limiter) (written int64, err error) {
 	if buf == nil { //default buffer size
 		buf = make([]byte, copyBufferSize)
 	}
@@ -133,18 +302,27 @@ loop:
 		case <-ctx.Done():
 			return written, ErrCancelCopy
 		default:
-			nr, er := src.Read(buf)
+			size := len(buf)
+			for _, l := range limits {
+				size = l.chunk(size)
+			}
+			nr, er := src.Read(buf[:size])
+			for _, l := range limits {
+				if nr > 0 && l.wait(ctx, nr) != nil {
+					return written, ErrCancelCopy
+				}
+			}
 			if nr > 0 {
 				nw, ew := dst.Write(buf[0:nr])
 				if nw > 0 {
 					written += int64(nw)
 				}
 				if ew != nil {
-					err = ew
+					err = &WriteError{Err: ew}
 					break loop
 				}
 				if nr != nw {
-					err = io.ErrShortWrite
+					err = &WriteError{Err: io.ErrShortWrite}
 					break loop
 				}
 			}
@@ -173,36 +351,15 @@ func GetFileStartOffset(localfilePath string) (int64, error) {
 	return f.Size(), nil
 }
 
-// small files should not use resume
-func IsFileShouldResume(contentLength int64) bool {
-	return contentLength >= int64(copyBufferSize*1000)
+// exmaple Range: bytes=1024-2047 for the second KiB, end is exclusive
+func rangeHeaderValue(begin int64, end int64) string {
+	return fmt.Sprintf(`bytes=%d-%d`, begin, end-1)
 }
 
-// exmaple Range: bytes=0-1023
-func rangeHeaderValue(file *os.File, currentLocalFileSize int64, contentLength int64) string {
-	var begin int64
-	if IsFileShouldResume(contentLength) {
-		// while process may killed suddenly, last buffer of the file has possibility to be broken. so over write last buffer.
-		modChunk := currentLocalFileSize % int64(copyBufferSize)
-		begin = currentLocalFileSize - modChunk
-		file.Seek(begin, 0)
-	}
-	return fmt.Sprintf(`bytes=%d-%d`, begin, contentLength)
-}
-
-// find download target file and its size to know the progress of download
-func setupDownloadFile(localPath string, useResume bool) (*os.File, int64, error) {
-	offset, err := GetFileStartOffset(localPath)
-	var file *os.File
-	if err != nil && os.IsNotExist(err) {
-		file, err = os.Create(localPath)
-		return file, 0, err
-	}
-	// use file that already exists
-	file, err = os.OpenFile(localPath, os.O_RDWR, os.ModeExclusive)
-	if err != nil {
-		// can't open file for some reason
-		return nil, 0, err
+// ifRangeValue validator for If-Range, weak ETags are not allowed there so Last-Modified is used instead.
+func ifRangeValue(etag string, lastModified string) string {
+	if etag != "" && !strings.HasPrefix(etag, `W/`) {
+		return etag
 	}
-	return file, offset, nil
+	return lastModified
 }
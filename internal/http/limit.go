@@ -0,0 +1,109 @@
+package internalhttp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// bandwidth limit of downloads, a token bucket shared by every connection it applies to.
+
+const limitBurst = 100 * time.Millisecond // bytes a limiter lets through at once, in time at its rate
+
+// Limiter token bucket limiting bytes per second. The zero value and a nil Limiter don't limit.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64   // bytes per second, 0 is unlimited
+	tokens float64 // bytes which may be read now, negative while readers wait
+	last   time.Time
+}
+
+// NewLimiter returns a limiter of rate bytes per second, 0 or less is unlimited.
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the limit, waiting readers get the new rate with their next read.
+func (l *Limiter) SetRate(rate int64) {
+	if rate < 0 {
+		rate = 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+}
+
+// Rate bytes per second, 0 is unlimited.
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// burst must be called with l.mu held.
+func (l *Limiter) burst() float64 {
+	return float64(l.rate) * limitBurst.Seconds()
+}
+
+// refill must be called with l.mu held.
+func (l *Limiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	}
+	l.last = now
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+}
+
+// chunk bytes a single read should ask for, so a slow limit is met in small steps instead of long pauses.
+func (l *Limiter) chunk(n int) int {
+	if l == nil {
+		return n
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b := int(l.burst()); l.rate > 0 && b < n {
+		if b < 1 {
+			return 1
+		}
+		return b
+	}
+	return n
+}
+
+// wait takes n bytes from the bucket and sleeps until the rate allows them.
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	l.refill(time.Now())
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
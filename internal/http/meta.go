@@ -0,0 +1,205 @@
+package internalhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// resume metadata saved next to the downloading file, so a later run continues exactly from verified ranges
+// and never stitches a changed remote file onto stale bytes. the sidecar is removed once the download completes.
+
+const (
+	MetaSuffix       = `.fdl.json` // MetaSuffix appended to the local file path for the resume sidecar
+	metaSaveInterval = time.Second // how often the sidecar is updated while downloading
+)
+
+// Meta content of the resume sidecar.
+type Meta struct {
+	URL          string     `json:"url"`
+	ETag         string     `json:"etag,omitempty"`
+	LastModified string     `json:"last_modified,omitempty"`
+	Length       int64      `json:"length"`
+	Segments     []*Segment `json:"segments"` // written bytes of every segment with their rolling hash
+}
+
+// MetaPath path of the resume sidecar of localFilePath, when its part file is next to it.
+func MetaPath(localFilePath string) string {
+	return localFilePath + MetaSuffix
+}
+
+// metaPath the resume sidecar is kept next to the part file.
+func (r *Request) metaPath() string {
+	return MetaPath(filepath.Join(filepath.Dir(r.partPath()), filepath.Base(r.LocalFilePath)))
+}
+
+// LoadMeta reads a resume sidecar.
+func LoadMeta(path string) (*Meta, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	meta := &Meta{}
+	if err := json.Unmarshal(b, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// mismatch tells why the sidecar doesn't belong to the file req downloads, empty if it does.
+func (m *Meta) mismatch(req *Request) string {
+	switch {
+	case m.URL != req.URL && !req.IsMirror(m.URL):
+		return `url ` + m.URL
+	case m.Length != req.FileSize:
+		return fmt.Sprintf(`length %d`, m.Length)
+	case req.ETag != "" && m.ETag != req.ETag:
+		return `etag ` + m.ETag
+	case req.LastModified != "" && m.LastModified != "" && m.LastModified != req.LastModified:
+		return `last modified ` + m.LastModified
+	case len(m.Segments) == 0:
+		return `no segments`
+	}
+	for _, s := range m.Segments {
+		if s.Start < 0 || s.End > m.Length || s.Start > s.End || s.Done < 0 || s.Start+s.Done > s.End {
+			return fmt.Sprintf(`segment %d-%d`, s.Start, s.End)
+		}
+	}
+	return ""
+}
+
+// prepare sets up the segments of req, continuing a previous download if its sidecar matches and its bytes verify.
+func (r *Request) prepare() {
+	meta, err := LoadMeta(r.metaPath())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			r.Log(`Ignoring unreadable resume metadata[`+r.metaPath()+`]:`, err)
+		}
+		r.plan = newSegmentPlan(r.FileSize, r.Connections)
+		r.Progress.seed(0)
+		return
+	}
+	if reason := meta.mismatch(r); reason != "" {
+		r.Log(`Resume metadata is for another file (` + reason + `), starting over[` + r.partPath() + `]`)
+		r.plan = newSegmentPlan(r.FileSize, r.Connections)
+		r.Progress.seed(0)
+		return
+	}
+	plan := &SegmentPlan{Size: meta.Length, Segments: meta.Segments}
+	verified := plan.verify(r.partPath())
+	r.Log(fmt.Sprintf(`Resuming from %d verified bytes in %d segments[%s]`, verified, len(plan.Segments), r.partPath()))
+	r.plan = plan
+	r.Progress.seed(verified)
+}
+
+// verify rehashes the written bytes of every segment from disk and resets segments that don't match.
+func (p *SegmentPlan) verify(partPath string) int64 {
+	file, err := os.Open(partPath)
+	if err != nil {
+		for _, s := range p.Segments {
+			s.reset()
+		}
+		return 0
+	}
+	defer file.Close()
+	var verified int64
+	for _, s := range p.Segments {
+		h := crc32.New(crcTable)
+		n, err := io.Copy(h, io.NewSectionReader(file, s.Start, s.Done))
+		if err != nil || n != s.Done || h.Sum32() != s.CRC {
+			s.reset()
+			continue
+		}
+		s.pos = s.Start + s.Done
+		verified += s.Done
+	}
+	return verified
+}
+
+// saveMetaEvery saves the sidecar if the last save is older than metaSaveInterval.
+func (r *Request) saveMetaEvery(file *os.File) {
+	if !r.saveMu.TryLock() {
+		// another connection is saving right now
+		return
+	}
+	defer r.saveMu.Unlock()
+	if time.Since(r.lastSave) < metaSaveInterval {
+		return
+	}
+	r.writeMeta(file)
+}
+
+// saveMeta saves the sidecar now.
+func (r *Request) saveMeta(file *os.File) {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	r.writeMeta(file)
+}
+
+func (r *Request) writeMeta(file *os.File) {
+	r.lastSave = time.Now()
+	// the sidecar must never claim bytes that are not on disk yet.
+	if err := file.Sync(); err != nil {
+		r.Log(`Could not sync file for resume metadata[`+r.partPath()+`]:`, err)
+		return
+	}
+	b, err := json.Marshal(&Meta{
+		URL:          r.URL,
+		ETag:         r.ETag,
+		LastModified: r.LastModified,
+		Length:       r.plan.Size,
+		Segments:     r.plan.snapshot(),
+	})
+	if err != nil {
+		return
+	}
+	path := r.metaPath()
+	if err := os.WriteFile(path+`.tmp`, b, 0644); err != nil {
+		r.Log(`Could not write resume metadata[`+path+`]:`, err)
+		return
+	}
+	if err := os.Rename(path+`.tmp`, path); err != nil {
+		r.Log(`Could not write resume metadata[`+path+`]:`, err)
+	}
+}
+
+// removeMeta deletes the sidecar.
+func (r *Request) removeMeta() {
+	path := r.metaPath()
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		r.Log(`Could not remove resume metadata[`+path+`]:`, err)
+	}
+}
+
+// failed keeps what a failed attempt has downloaded for the next one, or throws it away if it can't be resumed.
+func (r *Request) failed(file *os.File, err error) error {
+	var statusErr *StatusError
+	switch {
+	case errors.Is(err, ErrRemoteChanged):
+		// the bytes on disk belong to another version of the file, continue with a single plain download.
+		r.Log(`Falling back to a single connection download from the start[` + r.URL + `]`)
+		r.Connections = 1
+	case errors.As(err, &statusErr) && (statusErr.ClientError() || r.plan.Done() == 0):
+		// never keep an empty or refused file, the server will not continue it.
+	default:
+		r.saveMeta(file)
+		return err
+	}
+	r.discard(file)
+	return err
+}
+
+// discard throws away the part file and everything known about it.
+func (r *Request) discard(file *os.File) {
+	file.Close()
+	os.Remove(r.partPath())
+	r.removeMeta()
+	r.plan = nil
+	r.resetHash()
+	r.Progress.restart()
+}
@@ -0,0 +1,33 @@
+package internalhttp
+
+// downloads from several urls serving the same file.
+
+// SameFile reports whether o describes the same file as i, by length and validators.
+func (i *RemoteInfo) SameFile(o *RemoteInfo) bool {
+	return i.ContentLength >= 0 && i.ContentLength == o.ContentLength && i.ETag == o.ETag &&
+		(i.ETag != "" || i.LastModified == o.LastModified)
+}
+
+// Failover continues the download from url, info describes its file and mirrors serve the same file.
+// The bytes downloaded so far are kept when it is the same file, otherwise the download starts over.
+func (r *Request) Failover(url string, info *RemoteInfo, mirrors []string) {
+	current := &RemoteInfo{ContentLength: r.FileSize, Resumable: r.UseResume, ETag: r.ETag, LastModified: r.LastModified}
+	r.URL, r.Mirrors = url, mirrors
+	if current.SameFile(info) && info.Resumable == r.UseResume {
+		return
+	}
+	r.FileSize, r.UseResume, r.ETag, r.LastModified = info.ContentLength, info.Resumable, info.ETag, info.LastModified
+	r.plan = nil
+	r.resetHash()
+	r.Progress.restart()
+}
+
+// IsMirror reports whether url is one of the mirrors of r.
+func (r *Request) IsMirror(url string) bool {
+	for _, mirror := range r.Mirrors {
+		if mirror == url {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package internalhttp
+
+import "sync/atomic"
+
+// Progress counters of a download. The connections update them atomically,
+// so they can be sampled any time without slowing the download down.
+type Progress struct {
+	written  int64
+	offset   int64 // bytes on disk minus written, set when an attempt starts from a verified offset
+	resumed  int64
+	seeded   int32
+	conns    int32
+	attempts int32
+}
+
+// Written bytes transferred and written to the local file so far, including bytes a retry threw away.
+func (p *Progress) Written() int64 {
+	return atomic.LoadInt64(&p.written)
+}
+
+// Done bytes of the file on disk, the verified bytes an attempt started from and the ones written since.
+func (p *Progress) Done() int64 {
+	return atomic.LoadInt64(&p.written) + atomic.LoadInt64(&p.offset)
+}
+
+// Resumed verified bytes which were on disk when the download started, left by an earlier run. 0 once they are thrown away.
+func (p *Progress) Resumed() int64 {
+	return atomic.LoadInt64(&p.resumed)
+}
+
+// Connections number of connections receiving the file right now.
+func (p *Progress) Connections() int {
+	return int(atomic.LoadInt32(&p.conns))
+}
+
+// Attempts number of calls of DownloadFile.
+func (p *Progress) Attempts() int {
+	return int(atomic.LoadInt32(&p.attempts))
+}
+
+func (p *Progress) add(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.written, int64(n))
+	}
+}
+
+// seed sets the bytes on disk when an attempt starts, the first seed are the resumed bytes.
+// It must be called before the connections of the attempt write.
+func (p *Progress) seed(onDisk int64) {
+	if p == nil {
+		return
+	}
+	atomic.StoreInt64(&p.offset, onDisk-atomic.LoadInt64(&p.written))
+	if atomic.CompareAndSwapInt32(&p.seeded, 0, 1) {
+		atomic.StoreInt64(&p.resumed, onDisk)
+	}
+}
+
+// restart drops the bytes on disk when the download starts over from zero, what was resumed is thrown away.
+func (p *Progress) restart() {
+	if p == nil {
+		return
+	}
+	atomic.StoreInt64(&p.offset, -atomic.LoadInt64(&p.written))
+	atomic.StoreInt32(&p.seeded, 1)
+	atomic.StoreInt64(&p.resumed, 0)
+}
+
+func (p *Progress) addConn(n int32) {
+	if p != nil {
+		atomic.AddInt32(&p.conns, n)
+	}
+}
+
+func (p *Progress) addAttempt() {
+	if p != nil {
+		atomic.AddInt32(&p.attempts, 1)
+	}
+}
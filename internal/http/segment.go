@@ -0,0 +1,394 @@
+package internalhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// segmented download of a file over one or several connections.
+// a file of known size is always downloaded by segments, a single segment is the plain sequential download.
+
+const (
+	minSegmentSize = 1024 * 1024     // files are not split into segments smaller than this
+	minStealSize   = 2 * 1024 * 1024 // remaining bytes a segment needs to have half of it taken over by an idle connection
+)
+
+var (
+	// errSegmentDone stops writing a segment when it reached its end, which may move while stealing.
+	errSegmentDone = errors.New(`segment done`)
+	// errRangesIgnored the server sent the whole file for a range, the file can only be downloaded in one piece.
+	errRangesIgnored = errors.New(`server ignores ranges`)
+	crcTable         = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Segment byte range [Start, End) of a file, Done bytes from Start are written and hashed into CRC.
+type Segment struct {
+	Start int64  `json:"start"`
+	End   int64  `json:"end"`
+	Done  int64  `json:"done"`
+	CRC   uint32 `json:"crc32c"` // rolling hash of the written bytes
+	pos   int64  // position claimed by the writer, ahead of Start+Done while a write is in progress
+}
+
+// SegmentPlan segments of a file. it lives across download attempts, so a retry continues every segment where it stopped.
+type SegmentPlan struct {
+	mu       sync.Mutex
+	Size     int64
+	Segments []*Segment
+}
+
+// Segments number of segments a new download of size bytes is split into for n connections,
+// at most n and none smaller than minSegmentSize.
+func Segments(size int64, n int) int {
+	if max := int(size / minSegmentSize); n > max {
+		n = max
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// newSegmentPlan splits size bytes into Segments(size, n) segments.
+func newSegmentPlan(size int64, n int) *SegmentPlan {
+	n = Segments(size, n)
+	plan := &SegmentPlan{Size: size}
+	chunk := size / int64(n)
+	for i := 0; i < n; i++ {
+		s := &Segment{Start: int64(i) * chunk, End: int64(i+1) * chunk}
+		if i == n-1 {
+			s.End = size
+		}
+		s.pos = s.Start
+		plan.Segments = append(plan.Segments, s)
+	}
+	return plan
+}
+
+// Len number of segments.
+func (p *SegmentPlan) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.Segments)
+}
+
+// unfinished number of segments with bytes left to download.
+func (p *SegmentPlan) unfinished() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var n int
+	for _, s := range p.Segments {
+		if s.remaining() > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Done number of bytes written in all segments.
+func (p *SegmentPlan) Done() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var done int64
+	for _, s := range p.Segments {
+		done += s.Done
+	}
+	return done
+}
+
+// snapshot copies the segments for saving them.
+func (p *SegmentPlan) snapshot() []*Segment {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	segments := make([]*Segment, len(p.Segments))
+	for i, s := range p.Segments {
+		c := *s
+		segments[i] = &c
+	}
+	return segments
+}
+
+func (s *Segment) remaining() int64 {
+	return s.End - s.pos
+}
+
+func (s *Segment) reset() {
+	s.Done, s.CRC, s.pos = 0, 0, s.Start
+}
+
+// next returns an unfinished segment nobody works on, or splits the segment with most remaining bytes.
+func (p *SegmentPlan) next(active map[*Segment]bool) *Segment {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var slowest *Segment
+	for _, s := range p.Segments {
+		if s.remaining() <= 0 {
+			continue
+		}
+		if !active[s] {
+			active[s] = true
+			return s
+		}
+		if slowest == nil || s.remaining() > slowest.remaining() {
+			slowest = s
+		}
+	}
+	if slowest == nil || slowest.remaining() < minStealSize {
+		return nil
+	}
+	// take over the second half of the slowest segment, its connection stops writing at the new end.
+	split := slowest.pos + slowest.remaining()/2
+	stolen := &Segment{Start: split, End: slowest.End, pos: split}
+	slowest.End = split
+	p.Segments = append(p.Segments, stolen)
+	active[stolen] = true
+	return stolen
+}
+
+// claim reserves up to n bytes at the current position of s for writing.
+func (p *SegmentPlan) claim(s *Segment, n int) (int64, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r := s.remaining(); int64(n) > r {
+		n = int(r)
+	}
+	pos := s.pos
+	s.pos += int64(n)
+	return pos, n
+}
+
+// commit marks claimed bytes as written, unwritten ones are given back.
+func (p *SegmentPlan) commit(s *Segment, claimed int, written []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.pos -= int64(claimed - len(written))
+	s.Done += int64(len(written))
+	s.CRC = crc32.Update(s.CRC, crcTable, written)
+}
+
+// segmentWriter writes the body of a segment request at its position in the file.
+type segmentWriter struct {
+	file *os.File
+	plan *SegmentPlan
+	seg  *Segment
+	req  *Request
+}
+
+func (w *segmentWriter) Write(b []byte) (int, error) {
+	pos, n := w.plan.claim(w.seg, len(b))
+	if n == 0 {
+		return 0, errSegmentDone
+	}
+	written, err := w.file.WriteAt(b[:n], pos)
+	w.plan.commit(w.seg, n, b[:written])
+	w.req.hashWritten(pos, b[:written])
+	if written > 0 {
+		w.req.Progress.add(written)
+		w.req.saveMetaEvery(w.file)
+	}
+	if err != nil {
+		return written, err
+	}
+	if n < len(b) {
+		return written, errSegmentDone
+	}
+	return written, nil
+}
+
+// downloadSegments downloads the unfinished segments of the plan in parallel into one preallocated file.
+// at most req.Connections connections are opened, each takes the next segment when its own is done.
+func downloadSegments(ctx context.Context, req *Request) (Result, error) {
+	var result Result
+	plan := req.plan
+	file, err := os.OpenFile(req.partPath(), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return result, &WriteError{Err: err}
+	}
+	defer file.Close()
+	if err := file.Truncate(plan.Size); err != nil {
+		return result, &WriteError{Err: err}
+	}
+	if err := req.rehashPrefix(file); err != nil {
+		return result, &WriteError{Err: err}
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		firstErr  error
+		ignoredBy string // url which sent the whole file for a range
+		active    = make(map[*Segment]bool)
+		wg        sync.WaitGroup
+	)
+	// a retry or a sidecar may have more segments than connections
+	conns := plan.unfinished()
+	if req.Connections < conns {
+		conns = req.Connections
+	}
+	if conns < 1 {
+		conns = 1
+	}
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		url := req.source(i)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				seg := plan.next(active)
+				mu.Unlock()
+				if seg == nil {
+					return
+				}
+				res, err := downloadSegment(ctx, req, url, file, seg)
+				err = sourceError(url, err)
+				mu.Lock()
+				result.Written += res.Written
+				if res.StatusCode != 0 {
+					result.StatusCode = res.StatusCode
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+					if errors.Is(err, errRangesIgnored) {
+						ignoredBy = url
+					}
+					cancel()
+				}
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil && ignoredBy == req.URL {
+		// a mirror ignoring ranges is dropped, without range support from URL the file comes in one response
+		req.Log(`Server ignores ranges, downloading with a single connection from the start[` + req.URL + `]`)
+		req.UseResume = false
+		req.discard(file)
+		res, err := downloadStream(parent, req)
+		res.Written += result.Written
+		return res, err
+	}
+	if firstErr != nil {
+		if errors.Is(firstErr, ErrCancelCopy) {
+			req.Log(`Download File Cancelled[` + req.URL + `]`)
+		}
+		return result, req.failed(file, firstErr)
+	}
+	if err := req.finish(file, plan.Size); err != nil {
+		return result, err
+	}
+	if n := plan.Len(); n > 1 {
+		req.Log(fmt.Sprintf(`Download File Done[%s] in %d segments`, req.URL, n))
+	} else {
+		req.Log(`Download File Done[` + req.URL + `]`)
+	}
+	return result, nil
+}
+
+// source url connection i of a segmented download requests its segments from.
+func (r *Request) source(i int) string {
+	if i %= len(r.Mirrors) + 1; i > 0 {
+		return r.Mirrors[i-1]
+	}
+	return r.URL
+}
+
+// changed reports whether the validators of resp tell another version of the file than req downloads.
+func changed(req *Request, resp *http.Response) bool {
+	etag, lastModified := resp.Header.Get(`ETag`), resp.Header.Get(`Last-Modified`)
+	if etag != "" && req.ETag != "" {
+		return etag != req.ETag
+	}
+	return lastModified != "" && req.LastModified != "" && lastModified != req.LastModified
+}
+
+// downloadSegment requests the rest of seg from url and writes it at its position.
+// its errors don't tell the url, downloadSegments wraps them in a SourceError.
+func downloadSegment(ctx context.Context, req *Request, url string, file *os.File, seg *Segment) (Result, error) {
+	var result Result
+	plan := req.plan
+	plan.mu.Lock()
+	begin, end := seg.pos, seg.End
+	single := len(plan.Segments) == 1
+	plan.mu.Unlock()
+	if begin >= end {
+		return result, nil
+	}
+	r, err := http.NewRequestWithContext(ctx, `GET`, url, nil)
+	if err != nil {
+		return result, err
+	}
+	// the whole file is a plain request, everything else a range.
+	ranged := begin > 0 || end < plan.Size
+	if ranged {
+		r.Header.Set(`Range`, rangeHeaderValue(begin, end))
+		if v := ifRangeValue(req.ETag, req.LastModified); v != "" {
+			r.Header.Set(`If-Range`, v)
+		}
+		if single {
+			req.Log(`Resume enabled, added download header::`, r.Header)
+		}
+	}
+	resp, err := req.client().Do(r)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	req.Progress.addConn(1)
+	defer req.Progress.addConn(-1)
+	result.StatusCode = resp.StatusCode
+	switch {
+	case resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 && resp.ContentLength != plan.Size:
+		return result, fmt.Errorf(`%w: size is %d instead of %d`, ErrRemoteChanged, resp.ContentLength, plan.Size)
+	case resp.StatusCode == http.StatusOK && ranged && !single && changed(req, resp):
+		// If-Range found the file changed, the segments can't be stitched together.
+		return result, fmt.Errorf(`%w: whole file sent for range from %d`, ErrRemoteChanged, begin)
+	case resp.StatusCode == http.StatusOK && ranged && !single:
+		return result, fmt.Errorf(`%w: whole file sent for range from %d`, errRangesIgnored, begin)
+	case resp.StatusCode == http.StatusOK && ranged:
+		// whole file again, either the server ignores Range or If-Range found the file changed.
+		req.Log(fmt.Sprintf(`Server sent the whole file instead of range from %d, restarting from zero[%s]`, begin, url))
+		plan.mu.Lock()
+		seg.reset()
+		plan.mu.Unlock()
+		req.resetHash()
+		req.Progress.restart()
+		begin = 0
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusPartialContent && ranged:
+		if err := checkContentRange(resp.Header.Get(`Content-Range`), begin, plan.Size); err != nil {
+			return result, err
+		}
+	default:
+		return result, statusError(url, resp)
+	}
+	w := &segmentWriter{file: file, plan: plan, seg: seg, req: req}
+	result.Written, err = copyBuffer(ctx, w, resp.Body, nil, req.Limiters)
+	if errors.Is(err, errSegmentDone) {
+		return result, nil
+	}
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = fmt.Errorf(`%w: %w`, ErrShortBody, err)
+		}
+		return result, err
+	}
+	plan.mu.Lock()
+	remaining := seg.remaining()
+	plan.mu.Unlock()
+	if remaining > 0 {
+		return result, fmt.Errorf(`%w: range from %d ended %d bytes early`, ErrShortBody, begin, remaining)
+	}
+	return result, nil
+}
@@ -19,7 +19,7 @@ func main() {
 		},
 		&cli.StringFlag{
 			Name:  "file",
-			Usage: "file containing a list of newline separated urls to download",
+			Usage: "file containing a list of newline separated urls to download, each url may be followed by tab separated mirrors of the file and a checksum like sha256:<hex>",
 		},
 		&cli.BoolFlag{
 			Name:  "tor",
@@ -36,10 +36,19 @@ func main() {
 			Value: 0,
 			Usage: "number of retries to attempt when downloading",
 		},
+		&cli.IntFlag{
+			Name:  "segments",
+			Value: 1,
+			Usage: "number of connections to download a single large file with, if the server supports ranges",
+		},
 		&cli.IntFlag{
 			Name:  "timeout",
 			Value: 60,
-			Usage: "number of minutes to download before timing out",
+			Usage: "number of minutes to download before timing out, 0 for no timeout",
+		},
+		&cli.StringFlag{
+			Name:  "limit-rate",
+			Usage: "limit the download speed of all files together in bytes per second, units K, M and G are accepted like 500K or 5M",
 		},
 	}
 	app.Action = func(ctx *cli.Context) error {
@@ -0,0 +1,52 @@
+//go:build unix
+
+package test
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+// cpuTime user and system time used by this process.
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// BenchmarkDownload downloads from a local server, it reports throughput and cpu time per download.
+func BenchmarkDownload(b *testing.B) {
+	for _, bc := range []struct {
+		name     string
+		files    int
+		segments int
+	}{
+		{`single`, 1, 1},
+		{`parallel`, 4, 1},
+		{`segments`, 1, 4},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			srv := newTestServer(b, 32*1024*1024)
+			dir := b.TempDir()
+			conf := fd.Config{LogFunc: func(...interface{}) {}, MaxDownloadThreads: bc.files, SegmentsPerFile: bc.segments}
+			fdl := fd.New(&conf)
+			downloads := make([]*fd.Download, bc.files)
+			for i := range downloads {
+				downloads[i] = &fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, string(rune('a'+i)))}
+			}
+			b.SetBytes(int64(len(srv.content) * bc.files))
+			b.ResetTimer()
+			cpu := cpuTime()
+			for i := 0; i < b.N; i++ {
+				if _, err := fdl.MultipleFileDownload(downloads); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64((cpuTime()-cpu).Milliseconds())/float64(b.N), `cpu-ms/op`)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+func TestCancelDownloadFreesThread(t *testing.T) {
+	slow := newTestServer(t, 2*1024*1024)
+	slow.slowFirst = true
+	fast := newTestServer(t, 64*1024)
+	dir := t.TempDir()
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeout: time.Minute}
+	fdl := fd.New(&conf)
+	fdl.Start()
+	defer fdl.Close()
+	a := fdl.Enqueue(&fd.Download{URL: slow.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `a.bin`)})
+	b := fdl.Enqueue(&fd.Download{URL: fast.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `b.bin`)})
+	c := fdl.Enqueue(&fd.Download{URL: fast.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `c.bin`)})
+	waitState(t, fdl, a, string(fd.StateDownloading))
+	if !fdl.CancelDownload(c) {
+		t.Error(`expected queued job to be cancelled`)
+	}
+	start := time.Now()
+	if !fdl.CancelDownload(a) {
+		t.Fatal(`expected downloading job to be cancelled`)
+	}
+	fdl.Wait()
+	if time.Since(start) > time.Second {
+		t.Errorf(`expected the next job to get the thread right away, took %s`, time.Since(start))
+	}
+	for _, id := range []fd.JobID{a, c} {
+		if r, _ := fdl.Status(id); r.State != fd.StateCancelled || !errors.Is(r.Err, context.Canceled) {
+			t.Errorf(`expected cancelled job, got %+v`, r)
+		}
+	}
+	if r, _ := fdl.Status(b); r.State != fd.StateDone {
+		t.Errorf(`expected the other job to be done, got %+v`, r)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, `b.bin`)); !bytes.Equal(got, fast.content) {
+		t.Error(`file differs from served content`)
+	}
+	if fdl.CancelDownload(a) || fdl.CancelDownload(b) {
+		t.Error(`expected finished jobs not to be cancelled`)
+	}
+}
+
+func TestCancelledResults(t *testing.T) {
+	srv := newTestServer(t, 1024*1024)
+	srv.slowFirst = true
+	dir := t.TempDir()
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	downloads := []*fd.Download{
+		{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `a.bin`)},
+		{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `b.bin`)},
+	}
+	results, err := fd.New(&conf).MultipleFileDownloadContext(ctx, downloads)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf(`expected context.Canceled, got %v`, err)
+	}
+	for _, r := range results {
+		if r.State != fd.StateCancelled {
+			t.Errorf(`expected cancelled result, got %+v`, r)
+		}
+	}
+}
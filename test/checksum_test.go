@@ -0,0 +1,83 @@
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+	"golang.org/x/crypto/blake2b"
+)
+
+func sha256Checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return `sha256:` + hex.EncodeToString(sum[:])
+}
+
+func TestChecksumVerified(t *testing.T) {
+	srv := newTestServer(t, 8*1024*1024)
+	blake := blake2b.Sum512(srv.content)
+	for name, tc := range map[string]struct {
+		checksum string
+		segments int
+	}{
+		`sha256`:           {sha256Checksum(srv.content), 1},
+		`blake2b segments`: {`blake2b:` + hex.EncodeToString(blake[:]), 4},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, SegmentsPerFile: tc.segments}
+			path := filepath.Join(t.TempDir(), `file.bin`)
+			d := &fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: path, Checksum: tc.checksum}
+			if _, err := fd.New(&conf).MultipleFileDownload([]*fd.Download{d}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestChecksumOfResumedDownload(t *testing.T) {
+	srv := newTestServer(t, 4*1024*1024)
+	path := interruptedDownload(t, srv, 1)
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	d := &fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: path, Checksum: sha256Checksum(srv.content)}
+	if _, err := fd.New(&conf).MultipleFileDownload([]*fd.Download{d}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	srv := newTestServer(t, 1024*1024)
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 1, RetryWait: 10 * time.Millisecond}
+	path := filepath.Join(t.TempDir(), `file.bin`)
+	d := &fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: path, Checksum: sha256Checksum([]byte(`something else`))}
+	results, err := fd.New(&conf).MultipleFileDownload([]*fd.Download{d})
+	var checksumErr *fd.ChecksumError
+	if !errors.Is(err, fd.ErrChecksumMismatch) || !errors.As(results[0].Err, &checksumErr) {
+		t.Fatalf(`expected checksum mismatch, got %v`, err)
+	}
+	if results[0].Attempts != 2 || atomic.LoadInt32(&srv.gets) != 2 {
+		t.Errorf(`expected the mismatching download to be retried once, got %d attempts`, results[0].Attempts)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 0 {
+		t.Errorf(`mismatching file must be deleted, found %v`, entries)
+	}
+}
+
+func TestChecksumMismatchWithoutRetries(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, RetryWait: 10 * time.Millisecond}
+	d := &fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(t.TempDir(), `file.bin`), Checksum: sha256Checksum([]byte(`something else`))}
+	results, err := fd.New(&conf).MultipleFileDownload([]*fd.Download{d})
+	if !errors.Is(err, fd.ErrChecksumMismatch) {
+		t.Fatalf(`expected checksum mismatch, got %v`, err)
+	}
+	if results[0].Attempts != 2 {
+		t.Errorf(`expected the mismatching download to be downloaded again once, got %d attempts`, results[0].Attempts)
+	}
+}
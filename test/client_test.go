@@ -0,0 +1,73 @@
+package test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+// countingTransport counts requests sent through it.
+type countingTransport struct {
+	requests int32
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.requests, 1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestCustomTransport(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	transport := &countingTransport{}
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, Transport: transport}
+	if err := fd.New(&conf).SimpleFileDownload(srv.URL+`/file.bin`, filepath.Join(t.TempDir(), `file.bin`)); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&transport.requests) < 2 {
+		t.Errorf(`expected HEAD and GET through the transport, got %d requests`, transport.requests)
+	}
+}
+
+func TestProxyPerDownloader(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		srv.handle(w, r)
+	}))
+	defer proxy.Close()
+	dir := t.TempDir()
+	// the host only exists behind the proxy
+	viaProxy := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, Proxy: proxy.URL}
+	if err := fd.New(&viaProxy).SimpleFileDownload(`http://files.invalid/file.bin`, filepath.Join(dir, `a.bin`)); err != nil {
+		t.Fatal(err)
+	}
+	direct := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	if err := fd.New(&direct).SimpleFileDownload(srv.URL+`/file.bin`, filepath.Join(dir, `b.bin`)); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&proxied); n != 2 {
+		t.Errorf(`expected HEAD and GET of the first downloader only through the proxy, got %d`, n)
+	}
+	if http.DefaultClient.Transport != nil {
+		t.Error(`http.DefaultClient must not be modified`)
+	}
+	for _, name := range []string{`a.bin`, `b.bin`} {
+		if got, _ := os.ReadFile(filepath.Join(dir, name)); !bytes.Equal(got, srv.content) {
+			t.Errorf(`%s differs from served content`, name)
+		}
+	}
+}
+
+func TestInvalidProxy(t *testing.T) {
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, Proxy: "://bad"}
+	if err := fd.New(&conf).SimpleFileDownload(`http://files.invalid/file.bin`, filepath.Join(t.TempDir(), `a.bin`)); err == nil {
+		t.Error(`expected error for invalid proxy`)
+	}
+}
@@ -0,0 +1,64 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+func TestCallerContextCancels(t *testing.T) {
+	srv := newTestServer(t, 1024*1024)
+	srv.slowFirst = true
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	err := fd.New(&conf).SimpleFileDownloadContext(ctx, srv.URL+`/file.bin`, filepath.Join(t.TempDir(), `file.bin`))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf(`expected context.Canceled, got %v`, err)
+	}
+	if time.Since(start) > 1500*time.Millisecond {
+		t.Errorf(`download was not stopped by the context, took %s`, time.Since(start))
+	}
+}
+
+func TestCallerDeadline(t *testing.T) {
+	srv := newTestServer(t, 1024*1024)
+	srv.slowFirst = true
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, MaxRetry: 3}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	downloads := []*fd.Download{{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(t.TempDir(), `file.bin`)}}
+	results, err := fd.New(&conf).MultipleFileDownloadContext(ctx, downloads)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf(`expected context.DeadlineExceeded, got %v`, err)
+	}
+	if results[0].State != fd.StateFailed || results[0].Attempts != 1 {
+		t.Errorf(`expected a single failed attempt, got %+v`, results[0])
+	}
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	srv := newTestServer(t, 1024*1024)
+	srv.slowFirst = true
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeout: 200 * time.Millisecond}
+	err := fd.New(&conf).SimpleFileDownload(srv.URL+`/file.bin`, filepath.Join(t.TempDir(), `file.bin`))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf(`expected context.DeadlineExceeded, got %v`, err)
+	}
+}
+
+func TestCancelBeforeStart(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1}
+	fdl := fd.New(&conf)
+	fdl.Cancel()
+	err := fdl.SimpleFileDownload(srv.URL+`/file.bin`, filepath.Join(t.TempDir(), `file.bin`))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf(`expected context.Canceled, got %v`, err)
+	}
+}
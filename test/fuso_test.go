@@ -31,7 +31,7 @@ func TestMultipleFilesDownload(t *testing.T) {
 	var downloadFiles []*fd.Download
 	downloadFiles = append(downloadFiles, &fd.Download{URL: `https://files.hareruyamtg.com/img/goods/L/M21/EN/0001.jpg`, LocalFilePath: user.HomeDir + `/ugin.jpg`})
 	downloadFiles = append(downloadFiles, &fd.Download{URL: `https://files.hareruyamtg.com/img/goods/L/ELD/EN/BRAWL0329.jpg`, LocalFilePath: user.HomeDir + `/korvold.jpg`})
-	err := fdl.MultipleFileDownload(downloadFiles)
+	_, err := fdl.MultipleFileDownload(downloadFiles)
 	if err != nil {
 		t.Error(err)
 	}
@@ -126,7 +126,7 @@ func TestMultiFileDownloadCancelWhileDownloading(t *testing.T) {
 	downloadFiles = append(downloadFiles, &fd.Download{URL: "http://ipv4.download.thinkbroadband.com/512MB.zip", LocalFilePath: user.HomeDir + `/512.zip`})
 	downloadFiles = append(downloadFiles, &fd.Download{URL: "http://ipv4.download.thinkbroadband.com/200MB.zip", LocalFilePath: user.HomeDir + `/200.zip`})
 	// test download file 512MB
-	err := fileDownloader.MultipleFileDownload(downloadFiles)
+	_, err := fileDownloader.MultipleFileDownload(downloadFiles)
 	if err != nil {
 		t.Error(err)
 	}
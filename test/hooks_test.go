@@ -0,0 +1,78 @@
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+func TestHooks(t *testing.T) {
+	srv := newTestServer(t, 2*1024*1024)
+	srv.slowFirst = true
+	sum := sha256.Sum256(srv.content)
+	digest := `sha256:` + hex.EncodeToString(sum[:])
+	dir := t.TempDir()
+	var (
+		mu      sync.Mutex
+		calls   = map[string][]string{}
+		final   = map[string]fd.Event{}
+		running int32
+	)
+	record := func(name string) func(fd.Event) {
+		return func(e fd.Event) {
+			if atomic.AddInt32(&running, 1) != 1 {
+				t.Error(`hooks called at once`)
+			}
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			calls[e.Download.URL] = append(calls[e.Download.URL], name)
+			if name == `complete` || name == `error` {
+				final[e.Download.URL] = e
+			}
+			mu.Unlock()
+			atomic.AddInt32(&running, -1)
+		}
+	}
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 2, Hooks: fd.Hooks{
+		OnQueued:   record(`queued`),
+		OnStart:    record(`start`),
+		OnProgress: record(`progress`),
+		OnComplete: record(`complete`),
+		OnError:    record(`error`),
+	}}
+	fdl := fd.New(&conf)
+	file, missing := srv.URL+`/file.bin`, srv.URL+`/missing`
+	fdl.MultipleFileDownload([]*fd.Download{
+		{URL: file, LocalFilePath: filepath.Join(dir, `file.bin`), Checksum: digest},
+		{URL: missing, LocalFilePath: filepath.Join(dir, `missing.bin`)},
+	})
+	// the hooks have run when the download returned
+	mu.Lock()
+	defer mu.Unlock()
+	got := calls[file]
+	if len(got) < 4 || got[0] != `queued` || got[1] != `start` || got[len(got)-1] != `complete` {
+		t.Fatalf(`unexpected hooks of download: %v`, got)
+	}
+	for _, name := range got[2 : len(got)-1] {
+		if name != `progress` {
+			t.Errorf(`unexpected hooks of download: %v`, got)
+		}
+	}
+	e := final[file]
+	if e.State != fd.StateDone || e.Path != filepath.Join(dir, `file.bin`) || e.Size != int64(len(srv.content)) || e.Digest != digest || e.Duration <= 0 || e.Err != nil {
+		t.Errorf(`unexpected complete event: %+v`, e)
+	}
+	if got := calls[missing]; len(got) != 3 || got[0] != `queued` || got[1] != `start` || got[2] != `error` {
+		t.Errorf(`unexpected hooks of missing file: %v`, got)
+	}
+	if e := final[missing]; e.State != fd.StateFailed || !errors.Is(e.Err, fd.ErrNotFound) {
+		t.Errorf(`unexpected error event: %+v`, e)
+	}
+}
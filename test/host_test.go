@@ -0,0 +1,137 @@
+package test
+
+import (
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+	ihttp "github.com/sysgoblin/godownload/internal/http"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Duration{
+		`120`:                           2 * time.Minute,
+		` 0 `:                           0,
+		`Wed, 01 Jan 2020 00:00:30 GMT`: 30 * time.Second,
+		`Tue, 31 Dec 2019 23:00:00 GMT`: 0,
+		`99999999`:                      time.Hour,
+	} {
+		if got, ok := ihttp.ParseRetryAfter(value, now); !ok || got != want {
+			t.Errorf(`ParseRetryAfter(%q) = %s, %v, want %s`, value, got, ok, want)
+		}
+	}
+	for _, value := range []string{``, `-1`, `soon`} {
+		if _, ok := ihttp.ParseRetryAfter(value, now); ok {
+			t.Errorf(`ParseRetryAfter(%q) must fail`, value)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	srv.failGets, srv.failStatus, srv.retryAfter = 1, http.StatusServiceUnavailable, `1`
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, MaxRetry: 1, RetryWait: 10 * time.Millisecond}
+	start := time.Now()
+	if err := fd.New(&conf).SimpleFileDownload(srv.URL+`/file.bin`, filepath.Join(t.TempDir(), `file.bin`)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf(`retried after %s, before Retry-After`, elapsed)
+	}
+}
+
+func TestRetryAfterHoldsBackHost(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	srv.failGets, srv.failStatus, srv.retryAfter = 1, http.StatusTooManyRequests, `1`
+	dir := t.TempDir()
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 2, MaxRetry: 1, RetryWait: 10 * time.Millisecond}
+	fdl := fd.New(&conf)
+	fdl.Start()
+	defer fdl.Close()
+	first := fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `a.bin`)})
+	for atomic.LoadInt32(&srv.gets) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	second := fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `b.bin`)})
+	time.Sleep(300 * time.Millisecond)
+	if gets := atomic.LoadInt32(&srv.gets); gets != 1 {
+		t.Errorf(`host must be held back after 429, got %d GET requests`, gets)
+	}
+	if r, _ := fdl.Status(second); r.State != fd.StateQueued {
+		t.Errorf(`expected second download to wait in the queue, got %s`, r.State)
+	}
+	fdl.Wait()
+	for _, id := range []fd.JobID{first, second} {
+		if r, _ := fdl.Status(id); r.State != fd.StateDone {
+			t.Errorf(`unexpected result: %+v`, r)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	srv.failGets, srv.failStatus = 2, http.StatusInternalServerError
+	dir := t.TempDir()
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 2, MaxRetry: 3, RetryWait: 10 * time.Millisecond,
+		BreakerThreshold: 2, BreakerCooldown: 500 * time.Millisecond}
+	fdl := fd.New(&conf)
+	fdl.Start()
+	defer fdl.Close()
+	start := time.Now()
+	first := fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `a.bin`)})
+	for atomic.LoadInt32(&srv.gets) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the breaker is open, nothing is sent to the host until the cool-down is over
+	second := fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `b.bin`)})
+	time.Sleep(300 * time.Millisecond)
+	if gets := atomic.LoadInt32(&srv.gets); gets != 2 {
+		t.Errorf(`open breaker must stop requests, got %d GET requests`, gets)
+	}
+	fdl.Wait()
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf(`host was probed after %s, before the cool-down`, elapsed)
+	}
+	for _, id := range []fd.JobID{first, second} {
+		if r, _ := fdl.Status(id); r.State != fd.StateDone {
+			t.Errorf(`unexpected result: %+v`, r)
+		}
+	}
+	if gets := atomic.LoadInt32(&srv.gets); gets != 4 {
+		t.Errorf(`expected 2 failed and 2 successful GET requests, got %d`, gets)
+	}
+}
+
+func TestWaitingHostFreesThreads(t *testing.T) {
+	throttled, healthy := newTestServer(t, 64*1024), newTestServer(t, 64*1024)
+	throttled.failGets, throttled.failStatus, throttled.retryAfter = 2, http.StatusTooManyRequests, `2`
+	dir := t.TempDir()
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 2, MaxRetry: 1, RetryWait: 10 * time.Millisecond}
+	fdl := fd.New(&conf)
+	fdl.Start()
+	defer fdl.Close()
+	waiting := []fd.JobID{
+		fdl.Enqueue(&fd.Download{URL: throttled.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `a.bin`)}),
+		fdl.Enqueue(&fd.Download{URL: throttled.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `b.bin`)}),
+	}
+	for atomic.LoadInt32(&throttled.gets) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// both threads are free while the throttled host is waited for
+	other := fdl.Enqueue(&fd.Download{URL: healthy.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `c.bin`)})
+	time.Sleep(time.Second)
+	if r, _ := fdl.Status(other); r.State != fd.StateDone {
+		t.Errorf(`download from the healthy host must not wait for the throttled one, got %s`, r.State)
+	}
+	fdl.Wait()
+	for _, id := range waiting {
+		if r, _ := fdl.Status(id); r.State != fd.StateDone || r.Attempts != 2 {
+			t.Errorf(`expected download after Retry-After, got %+v`, r)
+		}
+	}
+}
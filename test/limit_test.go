@@ -0,0 +1,94 @@
+package test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+func TestParseRate(t *testing.T) {
+	for value, want := range map[string]int64{
+		`100`:    100,
+		`500K`:   500 * 1024,
+		`5M`:     5 * 1024 * 1024,
+		`1.5m`:   3 * 512 * 1024,
+		`2MiB`:   2 * 1024 * 1024,
+		`1GB/s`:  1024 * 1024 * 1024,
+		` 64kB `: 64 * 1024,
+		`0`:      0,
+	} {
+		if got, err := fd.ParseRate(value); err != nil || got != want {
+			t.Errorf(`ParseRate(%q) = %d, %v, want %d`, value, got, err, want)
+		}
+	}
+	for _, value := range []string{``, `M`, `fast`, `-1K`, `5T`, `NaN`} {
+		if _, err := fd.ParseRate(value); err == nil {
+			t.Errorf(`ParseRate(%q) must fail`, value)
+		}
+	}
+}
+
+func TestMaxBytesPerSecond(t *testing.T) {
+	srv := newTestServer(t, 1024*1024)
+	dir := t.TempDir()
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 2, MaxBytesPerSecond: 2 * 1024 * 1024}
+	start := time.Now()
+	// both files share the global limit, together they take a second
+	_, err := fd.New(&conf).MultipleFileDownload([]*fd.Download{
+		{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `a.bin`)},
+		{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `b.bin`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf(`2 MiB at 2 MiB/s took %s`, elapsed)
+	}
+}
+
+func TestDownloadMaxBytesPerSecond(t *testing.T) {
+	srv := newTestServer(t, 1024*1024)
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1}
+	fdl := fd.New(&conf)
+	start := time.Now()
+	_, err := fdl.MultipleFileDownload([]*fd.Download{
+		{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(t.TempDir(), `file.bin`), MaxBytesPerSecond: 1024 * 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf(`1 MiB at 1 MiB/s took %s`, elapsed)
+	}
+}
+
+func TestChangeMaxBytesPerSecond(t *testing.T) {
+	srv := newTestServer(t, 4*1024*1024)
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, MaxBytesPerSecond: 256 * 1024}
+	fdl := fd.New(&conf)
+	fdl.Start()
+	defer fdl.Close()
+	start := time.Now()
+	id := fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(t.TempDir(), `file.bin`), MaxBytesPerSecond: 128 * 1024})
+	time.Sleep(500 * time.Millisecond)
+	if done := fdl.Stats().Files[0].Done; done == 0 || done > 256*1024 {
+		t.Errorf(`expected a slow download, %d bytes after 500ms`, done)
+	}
+	// 16 seconds at the old limits
+	fdl.SetMaxBytesPerSecond(0)
+	if !fdl.SetDownloadMaxBytesPerSecond(id, 0) {
+		t.Fatal(`job is unknown`)
+	}
+	fdl.Wait()
+	if r, _ := fdl.Status(id); r.State != fd.StateDone {
+		t.Fatalf(`unexpected result: %+v`, r)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf(`download didn't speed up, took %s`, elapsed)
+	}
+	if fdl.SetDownloadMaxBytesPerSecond(id+1, 0) {
+		t.Error(`unknown job must not be found`)
+	}
+}
@@ -0,0 +1,97 @@
+package test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+// mirrorDownload downloads the file of srv with the mirrors and returns its result and content.
+func mirrorDownload(t *testing.T, conf fd.Config, url string, mirrors ...string) (*fd.Result, []byte) {
+	conf.LogFunc, conf.MaxDownloadThreads = myLogger, 1
+	path := filepath.Join(t.TempDir(), `file.bin`)
+	results, _ := fd.New(&conf).MultipleFileDownload([]*fd.Download{{URL: url, LocalFilePath: path, Mirrors: mirrors}})
+	got, _ := os.ReadFile(path)
+	return results[0], got
+}
+
+func TestMirrorFailover(t *testing.T) {
+	srv := newTestServer(t, 256*1024)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	for name, url := range map[string]string{
+		`missing file`: srv.URL + `/missing`,
+		`dead host`:    down.URL + `/file.bin`,
+	} {
+		r, got := mirrorDownload(t, fd.Config{}, url, srv.URL+`/file.bin`)
+		if r.State != fd.StateDone || r.Attempts != 2 || !bytes.Equal(got, srv.content) {
+			t.Errorf(`%s: expected download from mirror after one failed attempt, got %+v`, name, r)
+		}
+	}
+	// every mirror failed
+	if r, _ := mirrorDownload(t, fd.Config{}, srv.URL+`/missing`, down.URL+`/file.bin`); r.State != fd.StateFailed || r.Attempts != 2 {
+		t.Errorf(`expected failed download after trying both urls, got %+v`, r)
+	}
+}
+
+func TestSegmentsFromMirrors(t *testing.T) {
+	// servers of the same size serve the same content
+	a, b := newTestServer(t, 4*1024*1024), newTestServer(t, 4*1024*1024)
+	r, got := mirrorDownload(t, fd.Config{SegmentsPerFile: 4}, a.URL+`/file.bin`, b.URL+`/file.bin`)
+	if r.State != fd.StateDone || !bytes.Equal(got, a.content) {
+		t.Fatalf(`download from mirrors failed: %+v`, r)
+	}
+	if atomic.LoadInt32(&a.gets) == 0 || atomic.LoadInt32(&b.gets) == 0 {
+		t.Errorf(`expected segments from both mirrors, got %d and %d GET requests`, a.gets, b.gets)
+	}
+}
+
+func TestSegmentsSkipOtherFile(t *testing.T) {
+	a, b := newTestServer(t, 4*1024*1024), newTestServer(t, 4*1024*1024)
+	b.etag = `"v9"`
+	r, got := mirrorDownload(t, fd.Config{SegmentsPerFile: 4}, a.URL+`/file.bin`, b.URL+`/file.bin`)
+	if r.State != fd.StateDone || !bytes.Equal(got, a.content) {
+		t.Fatalf(`download failed: %+v`, r)
+	}
+	if gets := atomic.LoadInt32(&b.gets); gets != 0 {
+		t.Errorf(`mirror with another ETag must not be used for segments, got %d GET requests`, gets)
+	}
+}
+
+func TestSegmentsDropFailedMirror(t *testing.T) {
+	a, b := newTestServer(t, 4*1024*1024), newTestServer(t, 4*1024*1024)
+	b.failGets, b.failStatus = 100, http.StatusInternalServerError
+	r, got := mirrorDownload(t, fd.Config{SegmentsPerFile: 4}, a.URL+`/file.bin`, b.URL+`/file.bin`)
+	if r.State != fd.StateDone || !bytes.Equal(got, a.content) {
+		t.Fatalf(`download without the failed mirror failed: %+v`, r)
+	}
+	if gets := atomic.LoadInt32(&b.gets); gets == 0 {
+		t.Error(`expected requests to the failing mirror`)
+	}
+}
+
+func TestSegmentsDropCutMirror(t *testing.T) {
+	a, b := newTestServer(t, 4*1024*1024), newTestServer(t, 4*1024*1024)
+	// every GET of the mirror ends early
+	b.failGets = 100
+	// a failure charged to the healthy host would hold it back for the cooldown
+	conf := fd.Config{SegmentsPerFile: 4, BreakerThreshold: 1, BreakerCooldown: 10 * time.Second}
+	start := time.Now()
+	r, got := mirrorDownload(t, conf, a.URL+`/file.bin`, b.URL+`/file.bin`)
+	if r.State != fd.StateDone || !bytes.Equal(got, a.content) {
+		t.Fatalf(`download without the cut mirror failed: %+v`, r)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf(`failure of the mirror held back the healthy host for %s`, elapsed)
+	}
+	if gets := atomic.LoadInt32(&b.gets); gets == 0 {
+		t.Error(`expected requests to the cut mirror`)
+	}
+}
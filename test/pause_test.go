@@ -0,0 +1,96 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+	ihttp "github.com/sysgoblin/godownload/internal/http"
+)
+
+// waitState polls the job until it is in state s.
+func waitState(t *testing.T, fdl *fd.FileDownloader, id fd.JobID, state string) *fd.Result {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r, _ := fdl.Status(id)
+		if string(r.State) == state || time.Now().After(deadline) {
+			return r
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	srv := newTestServer(t, 2*1024*1024)
+	srv.slowFirst = true
+	path := filepath.Join(t.TempDir(), `file.bin`)
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeout: time.Minute}
+	fdl := fd.New(&conf)
+	fdl.Start()
+	defer fdl.Close()
+	id := fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: path})
+	waitState(t, fdl, id, string(fd.StateDownloading))
+	time.Sleep(300 * time.Millisecond)
+	if !fdl.Pause(id) {
+		t.Fatal(`expected downloading job to be paused`)
+	}
+	if r := waitState(t, fdl, id, string(fd.StatePaused)); r.State != fd.StatePaused || r.Err != nil {
+		t.Fatalf(`expected job to be paused, got %+v`, r)
+	}
+	// Wait doesn't wait for paused jobs
+	fdl.Wait()
+	if _, err := ihttp.LoadMeta(ihttp.MetaPath(path)); err != nil {
+		t.Errorf(`expected resume sidecar of paused download: %v`, err)
+	}
+	if fdl.Resume(id) != true || fdl.Resume(id) != false {
+		t.Error(`expected only the paused job to be resumed`)
+	}
+	fdl.Wait()
+	if r, _ := fdl.Status(id); r.State != fd.StateDone || r.Attempts != 2 {
+		t.Errorf(`expected job to be done in 2 attempts, got %+v`, r)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, srv.content) {
+		t.Fatal(`file differs from served content`)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if last := srv.ranges[len(srv.ranges)-1]; last == `` || strings.HasPrefix(last, `bytes=0-`) {
+		t.Errorf(`expected resumed request to continue with a range, got %q`, last)
+	}
+}
+
+func TestPauseAll(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	dir := t.TempDir()
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 2, DownloadTimeout: time.Minute}
+	fdl := fd.New(&conf)
+	fdl.PauseAll()
+	fdl.Start()
+	a := fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `a.bin`)})
+	b := fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `b.bin`)})
+	fdl.Wait()
+	for _, id := range []fd.JobID{a, b} {
+		if r, _ := fdl.Status(id); r.State != fd.StatePaused {
+			t.Errorf(`expected job to be paused, got %s`, r.State)
+		}
+	}
+	fdl.ResumeAll()
+	fdl.Wait()
+	for _, id := range []fd.JobID{a, b} {
+		if r, _ := fdl.Status(id); r.State != fd.StateDone {
+			t.Errorf(`expected job to be done, got %+v`, r)
+		}
+	}
+	c := fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `c.bin`)})
+	fdl.Pause(c)
+	fdl.Close()
+	if r, _ := fdl.Status(c); r.State != fd.StateFailed || !errors.Is(r.Err, fd.ErrClosed) {
+		t.Errorf(`expected paused job to fail on Close, got %+v`, r)
+	}
+}
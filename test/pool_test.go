@@ -0,0 +1,67 @@
+package test
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+func enqueueFiles(fdl *fd.FileDownloader, srv *testServer, dir string, n int) {
+	for i := 0; i < n; i++ {
+		fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, fmt.Sprintf(`%d.bin`, i))})
+	}
+}
+
+func TestExactDownloadThreads(t *testing.T) {
+	srv := newTestServer(t, 256*1024)
+	srv.slowFirst = true
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 2, DownloadTimeout: time.Minute}
+	fdl := fd.New(&conf)
+	enqueueFiles(fdl, srv, t.TempDir(), 6)
+	fdl.Start()
+	fdl.Close()
+	if got := atomic.LoadInt32(&srv.maxInFlight); got != 2 {
+		t.Errorf(`expected 2 downloads at once, got %d`, got)
+	}
+}
+
+func TestDefaultDownloadThreads(t *testing.T) {
+	srv := newTestServer(t, 256*1024)
+	srv.slowFirst = true
+	conf := fd.Config{LogFunc: myLogger, DownloadTimeout: time.Minute}
+	fdl := fd.New(&conf)
+	enqueueFiles(fdl, srv, t.TempDir(), 6)
+	fdl.Close()
+	if got := atomic.LoadInt32(&srv.maxInFlight); got != 3 {
+		t.Errorf(`expected default of 3 downloads at once, got %d`, got)
+	}
+}
+
+func TestResizeDownloadThreads(t *testing.T) {
+	srv := newTestServer(t, 256*1024)
+	srv.slowFirst = true
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeout: time.Minute}
+	fdl := fd.New(&conf)
+	enqueueFiles(fdl, srv, t.TempDir(), 12)
+	fdl.Start()
+	time.Sleep(200 * time.Millisecond)
+	if got := atomic.LoadInt32(&srv.maxInFlight); got != 1 {
+		t.Errorf(`expected 1 download at once before resize, got %d`, got)
+	}
+	fdl.SetMaxDownloadThreads(4)
+	time.Sleep(300 * time.Millisecond)
+	if got := atomic.LoadInt32(&srv.maxInFlight); got != 4 {
+		t.Errorf(`expected 4 downloads at once after resize, got %d`, got)
+	}
+	fdl.SetMaxDownloadThreads(2)
+	time.Sleep(time.Second)
+	atomic.StoreInt32(&srv.maxInFlight, 0)
+	fdl.Close()
+	if got := atomic.LoadInt32(&srv.maxInFlight); got > 2 {
+		t.Errorf(`expected at most 2 downloads at once after shrinking, got %d`, got)
+	}
+}
@@ -0,0 +1,59 @@
+package test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+func TestHeadRefused(t *testing.T) {
+	srv := newTestServer(t, 4*1024*1024)
+	srv.noHead = true
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, SegmentsPerFile: 2}
+	path := filepath.Join(t.TempDir(), `file.bin`)
+	if err := fd.New(&conf).SimpleFileDownload(srv.URL+`/file.bin`, path); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, srv.content) {
+		t.Fatal(`file differs from served content`)
+	}
+	if srv.ranges[0] != `bytes=0-0` {
+		t.Errorf(`expected size probe with a range request, got %q`, srv.ranges[0])
+	}
+	if len(srv.ranges) < 3 || srv.ranges[1] == `` {
+		t.Errorf(`expected probe and 2 segments from the probed size, got %v`, srv.ranges)
+	}
+}
+
+func TestUnknownSize(t *testing.T) {
+	srv := newTestServer(t, 1024*1024)
+	srv.chunked = true
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, RequiresDetailProgress: true}
+	path := filepath.Join(t.TempDir(), `file.bin`)
+	if err := fd.New(&conf).SimpleFileDownload(srv.URL+`/file.bin`, path); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, srv.content) {
+		t.Fatal(`file differs from served content`)
+	}
+}
+
+func TestBadURLDoesNotStopBatch(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	dir := t.TempDir()
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1}
+	downloads := []*fd.Download{
+		{URL: `http://127.0.0.1:1/file.bin`, LocalFilePath: filepath.Join(dir, `bad.bin`)},
+		{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `good.bin`)},
+	}
+	results, err := fd.New(&conf).MultipleFileDownload(downloads)
+	if err == nil || results[0].State != fd.StateFailed {
+		t.Errorf(`expected unreachable url to fail, got %+v`, results[0])
+	}
+	if results[1].State != fd.StateDone {
+		t.Errorf(`expected good url to be downloaded, got %+v`, results[1])
+	}
+}
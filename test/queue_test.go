@@ -0,0 +1,108 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+func TestDownloaderIsReusable(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	dir := t.TempDir()
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeout: time.Minute}
+	fdl := fd.New(&conf)
+	for _, name := range []string{`a.bin`, `b.bin`} {
+		if err := fdl.SimpleFileDownload(srv.URL+`/file.bin`, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+		if fdl.State != fd.StateDone {
+			t.Errorf(`expected state done after download, got %s`, fdl.State)
+		}
+	}
+	downloads := []*fd.Download{{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `c.bin`)}}
+	if _, err := fdl.MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{`a.bin`, `b.bin`, `c.bin`} {
+		if got, _ := os.ReadFile(filepath.Join(dir, name)); !bytes.Equal(got, srv.content) {
+			t.Errorf(`%s differs from served content`, name)
+		}
+	}
+}
+
+func TestEnqueueWhileRunning(t *testing.T) {
+	srv := newTestServer(t, 1024*1024)
+	srv.slowFirst = true
+	dir := t.TempDir()
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeout: time.Minute}
+	fdl := fd.New(&conf)
+	first := fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `a.bin`)})
+	if r, ok := fdl.Status(first); !ok || r.State != fd.StateQueued {
+		t.Errorf(`expected queued job before Start, got %+v`, r)
+	}
+	fdl.Start()
+	time.Sleep(200 * time.Millisecond)
+	if r, _ := fdl.Status(first); r.State != fd.StateDownloading {
+		t.Errorf(`expected first job to be downloading, got %s`, r.State)
+	}
+	second := fdl.Enqueue(&fd.Download{URL: srv.URL + `/missing`, LocalFilePath: filepath.Join(dir, `missing`)})
+	if r, _ := fdl.Status(second); r.State != fd.StateQueued {
+		t.Errorf(`expected second job to wait for the only thread, got %s`, r.State)
+	}
+	fdl.Wait()
+	if r, _ := fdl.Status(first); r.State != fd.StateDone || r.BytesWritten != int64(len(srv.content)) {
+		t.Errorf(`unexpected result of first job: %+v`, r)
+	}
+	if r, _ := fdl.Status(second); r.State != fd.StateFailed || !errors.Is(r.Err, fd.ErrNotFound) {
+		t.Errorf(`unexpected result of second job: %+v`, r)
+	}
+	fdl.Close()
+	if fdl.State != fd.StateDone {
+		t.Errorf(`expected state done after Close, got %s`, fdl.State)
+	}
+	late := fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `b.bin`)})
+	if r, _ := fdl.Status(late); r.State != fd.StateFailed || !errors.Is(r.Err, fd.ErrClosed) {
+		t.Errorf(`expected job enqueued after Close to fail, got %+v`, r)
+	}
+	if _, ok := fdl.Status(fd.JobID(99)); ok {
+		t.Error(`expected unknown job id not to be found`)
+	}
+}
+
+func TestKeepFinished(t *testing.T) {
+	srv := newTestServer(t, 16*1024)
+	dir := t.TempDir()
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, KeepFinished: 2}
+	fdl := fd.New(&conf)
+	var ids []fd.JobID
+	for _, name := range []string{`a.bin`, `b.bin`, `c.bin`, `d.bin`} {
+		ids = append(ids, fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, name)}))
+	}
+	fdl.Start()
+	fdl.Wait()
+	if _, ok := fdl.Status(ids[0]); ok {
+		t.Error(`expected the oldest finished job to be forgotten`)
+	}
+	if files := fdl.Stats().Files; len(files) != 2 || files[0].ID != ids[2] || files[1].ID != ids[3] {
+		t.Errorf(`expected stats of the last 2 finished jobs, got %+v`, files)
+	}
+	if !fdl.Forget(ids[3]) || fdl.Forget(ids[3]) {
+		t.Error(`expected a finished job to be forgotten once`)
+	}
+	if size := atomic.LoadInt64(&fdl.TotalFilesSize); size != int64(len(srv.content)) {
+		t.Errorf(`expected the size of the only kept file, got %d`, size)
+	}
+	fdl.PauseAll()
+	paused := fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `e.bin`)})
+	if fdl.Forget(paused) {
+		t.Error(`unfinished job must not be forgotten`)
+	}
+	fdl.ResumeAll()
+	fdl.Close()
+}
@@ -0,0 +1,233 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+	ihttp "github.com/sysgoblin/godownload/internal/http"
+)
+
+// interruptedDownload leaves a partial file and its resume sidecar behind, like a killed process.
+func interruptedDownload(t *testing.T, srv *testServer, segments int) string {
+	path := filepath.Join(t.TempDir(), `file.bin`)
+	atomic.StoreInt32(&srv.failGets, 1)
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, SegmentsPerFile: segments}
+	if err := fd.New(&conf).SimpleFileDownload(srv.URL+`/file.bin`, path); err == nil {
+		t.Fatal(`expected first download to fail`)
+	}
+	if _, err := ihttp.LoadMeta(ihttp.MetaPath(path)); err != nil {
+		t.Fatalf(`expected resume sidecar after failed download: %v`, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf(`incomplete file must not be at its final path: %v`, err)
+	}
+	srv.mu.Lock()
+	srv.ranges, srv.ifRanges = nil, nil
+	srv.mu.Unlock()
+	return path
+}
+
+// resumeDownload downloads the file again, it returns its content and the bytes written by this download.
+func resumeDownload(t *testing.T, srv *testServer, path string, segments int) ([]byte, int64) {
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, SegmentsPerFile: segments}
+	results, err := fd.New(&conf).MultipleFileDownload([]*fd.Download{{URL: srv.URL + `/file.bin`, LocalFilePath: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{ihttp.MetaPath(path), path + `.part`} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf(`%s must be removed after download: %v`, p, err)
+		}
+	}
+	got, _ := os.ReadFile(path)
+	return got, results[0].BytesWritten
+}
+
+func TestResumeFromSidecar(t *testing.T) {
+	srv := newTestServer(t, 4*1024*1024)
+	path := interruptedDownload(t, srv, 1)
+	meta, _ := ihttp.LoadMeta(ihttp.MetaPath(path))
+	done := meta.Segments[0].Done
+	got, _ := resumeDownload(t, srv, path, 1)
+	if !bytes.Equal(got, srv.content) {
+		t.Fatalf(`resumed file differs from served content (%d / %d bytes)`, len(got), len(srv.content))
+	}
+	if want := `bytes=` + strconv.FormatInt(done, 10) + `-` + strconv.Itoa(len(srv.content)-1); srv.ranges[0] != want {
+		t.Errorf(`expected Range %q, got %q`, want, srv.ranges[0])
+	}
+	if srv.ifRanges[0] != `"v1"` {
+		t.Errorf(`expected If-Range with ETag, got %q`, srv.ifRanges[0])
+	}
+}
+
+func TestResumeSegmentsFromSidecar(t *testing.T) {
+	srv := newTestServer(t, 8*1024*1024)
+	path := interruptedDownload(t, srv, 4)
+	got, written := resumeDownload(t, srv, path, 4)
+	if !bytes.Equal(got, srv.content) {
+		t.Fatalf(`resumed file differs from served content (%d / %d bytes)`, len(got), len(srv.content))
+	}
+	if written >= int64(len(srv.content)) {
+		t.Errorf(`resume downloaded %d bytes, the whole file again`, written)
+	}
+}
+
+func TestResumeIgnoresCorruptedBytes(t *testing.T) {
+	srv := newTestServer(t, 4*1024*1024)
+	path := interruptedDownload(t, srv, 1)
+	f, _ := os.OpenFile(path+`.part`, os.O_RDWR, 0)
+	f.WriteAt([]byte(`corrupted`), 100)
+	f.Close()
+	got, _ := resumeDownload(t, srv, path, 1)
+	if !bytes.Equal(got, srv.content) {
+		t.Fatal(`corrupted bytes were kept on resume`)
+	}
+}
+
+func TestResumeRestartsWhenRangeIgnored(t *testing.T) {
+	srv := newTestServer(t, 4*1024*1024)
+	path := interruptedDownload(t, srv, 1)
+	srv.ignoreRange = true
+	got, _ := resumeDownload(t, srv, path, 1)
+	if !bytes.Equal(got, srv.content) {
+		t.Fatalf(`file differs from served content after server ignored Range (%d / %d bytes)`, len(got), len(srv.content))
+	}
+}
+
+func TestResumeRestartsWhenFileChanged(t *testing.T) {
+	srv := newTestServer(t, 4*1024*1024)
+	path := interruptedDownload(t, srv, 1)
+	// changed between HEAD and GET, If-Range makes the server send the new file
+	srv.changed = bytes.Repeat([]byte{'y'}, len(srv.content))
+	got, _ := resumeDownload(t, srv, path, 1)
+	if !bytes.Equal(got, srv.changed) {
+		t.Fatal(`stale partial file was stitched onto the changed file`)
+	}
+}
+
+func TestResumeDiscardsSidecarOfChangedFile(t *testing.T) {
+	srv := newTestServer(t, 4*1024*1024)
+	path := interruptedDownload(t, srv, 1)
+	// changed between two runs
+	srv.content, srv.etag = bytes.Repeat([]byte{'z'}, len(srv.content)), `"v3"`
+	got, _ := resumeDownload(t, srv, path, 1)
+	if !bytes.Equal(got, srv.content) {
+		t.Fatal(`stale partial file was stitched onto the changed file`)
+	}
+	if srv.ranges[0] != `` {
+		t.Errorf(`expected a plain request for the changed file, got Range %q`, srv.ranges[0])
+	}
+}
+
+func TestPartFileInTempDir(t *testing.T) {
+	srv := newTestServer(t, 1024*1024)
+	srv.failGets = 1
+	dir, tmp := t.TempDir(), t.TempDir()
+	path := filepath.Join(dir, `file.bin`)
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, PartSuffix: `.downloading`, TempDir: tmp}
+	if err := fd.New(&conf).SimpleFileDownload(srv.URL+`/file.bin`, path); err == nil {
+		t.Fatal(`expected first download to fail`)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, `file.bin.downloading`)); err != nil {
+		t.Fatalf(`expected part file in temp dir: %v`, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf(`nothing may be written to the target dir before completion, found %v`, entries)
+	}
+	if err := fd.New(&conf).SimpleFileDownload(srv.URL+`/file.bin`, path); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, srv.content) {
+		t.Fatal(`file differs from served content`)
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf(`temp dir must be empty after download, found %v`, entries)
+	}
+}
+
+func TestResumeProgress(t *testing.T) {
+	srv := newTestServer(t, 4*1024*1024)
+	path := interruptedDownload(t, srv, 1)
+	meta, _ := ihttp.LoadMeta(ihttp.MetaPath(path))
+	done := meta.Segments[0].Done
+	size := int64(len(srv.content))
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1}
+	fdl := fd.New(&conf)
+	results, err := fdl.MultipleFileDownload([]*fd.Download{{URL: srv.URL + `/file.bin`, LocalFilePath: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; r.Resumed != done || r.BytesWritten != size-done {
+		t.Errorf(`expected %d resumed and %d written bytes, got %d and %d`, done, size-done, r.Resumed, r.BytesWritten)
+	}
+	stats := fdl.Stats()
+	if f := stats.Files[0]; f.Done != size || f.Resumed != done || stats.Done != size || stats.Resumed != done {
+		t.Errorf(`unexpected stats of resumed download: %+v`, stats)
+	}
+}
+
+// partialDownload leaves a part file and a sidecar of segments whose first halves are downloaded.
+func partialDownload(t *testing.T, srv *testServer, segments int) string {
+	path := filepath.Join(t.TempDir(), `file.bin`)
+	size := int64(len(srv.content))
+	meta := &ihttp.Meta{URL: srv.URL + `/file.bin`, ETag: srv.etag, Length: size}
+	part := make([]byte, size)
+	for i := int64(0); i < int64(segments); i++ {
+		s := &ihttp.Segment{Start: i * size / int64(segments), End: (i + 1) * size / int64(segments)}
+		s.Done = (s.End - s.Start) / 2
+		copy(part[s.Start:], srv.content[s.Start:s.Start+s.Done])
+		s.CRC = crc32.Checksum(srv.content[s.Start:s.Start+s.Done], crc32.MakeTable(crc32.Castagnoli))
+		meta.Segments = append(meta.Segments, s)
+	}
+	b, _ := json.Marshal(meta)
+	if err := os.WriteFile(ihttp.MetaPath(path), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+`.part`, part, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestResumeSegmentsWithFewerConnections(t *testing.T) {
+	srv := newTestServer(t, 4*1024*1024)
+	srv.slow = true
+	path := partialDownload(t, srv, 4)
+	got, written := resumeDownload(t, srv, path, 1)
+	if !bytes.Equal(got, srv.content) {
+		t.Fatalf(`resumed file differs from served content (%d / %d bytes)`, len(got), len(srv.content))
+	}
+	if written != int64(len(srv.content))/2 {
+		t.Errorf(`expected the missing halves of the segments to be downloaded, got %d bytes`, written)
+	}
+	// the segments of the sidecar are downloaded one after the other
+	if max := atomic.LoadInt32(&srv.maxInFlight); max != 1 {
+		t.Errorf(`expected a single connection, got %d`, max)
+	}
+}
+
+func TestResumeProgressAfterRestart(t *testing.T) {
+	srv := newTestServer(t, 4*1024*1024)
+	path := interruptedDownload(t, srv, 1)
+	srv.ignoreRange = true
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1}
+	fdl := fd.New(&conf)
+	results, err := fdl.MultipleFileDownload([]*fd.Download{{URL: srv.URL + `/file.bin`, LocalFilePath: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the resumed bytes were thrown away when the whole file came again
+	if r := results[0]; r.Resumed != 0 {
+		t.Errorf(`expected no resumed bytes after restart, got %d`, r.Resumed)
+	}
+	if f := fdl.Stats().Files[0]; f.Done != f.Total || f.Resumed != 0 {
+		t.Errorf(`unexpected stats of restarted download: %+v`, f)
+	}
+}
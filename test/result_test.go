@@ -0,0 +1,35 @@
+package test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+func TestResultsOfMultipleFileDownload(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	dir := t.TempDir()
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1}
+	downloads := []*fd.Download{
+		{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `file.bin`)},
+		{URL: srv.URL + `/missing`, LocalFilePath: filepath.Join(dir, `missing`)},
+	}
+	results, err := fd.New(&conf).MultipleFileDownload(downloads)
+	if !errors.Is(err, fd.ErrNotFound) {
+		t.Errorf(`expected joined error to contain ErrNotFound, got %v`, err)
+	}
+	if len(results) != 2 {
+		t.Fatalf(`expected 2 results, got %d`, len(results))
+	}
+	ok := results[0]
+	if ok.State != fd.StateDone || ok.Err != nil || ok.BytesWritten != int64(len(srv.content)) || ok.StatusCode/100 != 2 || ok.Attempts != 1 {
+		t.Errorf(`unexpected result of successful download: %+v`, ok)
+	}
+	missing := results[1]
+	var statusErr *fd.StatusError
+	if missing.State != fd.StateFailed || missing.StatusCode != 404 || !errors.As(missing.Err, &statusErr) || statusErr.StatusCode != 404 {
+		t.Errorf(`unexpected result of missing download: %+v`, missing)
+	}
+}
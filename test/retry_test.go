@@ -0,0 +1,64 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+func TestRetryAfterDroppedConnection(t *testing.T) {
+	srv := newTestServer(t, 1<<20)
+	srv.failGets = 2
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 2, RetryWait: 10 * time.Millisecond}
+	path := filepath.Join(t.TempDir(), `file.bin`)
+	if err := fd.New(&conf).SimpleFileDownload(srv.URL+`/file.bin`, path); err != nil {
+		t.Fatal(err)
+	}
+	if gets := atomic.LoadInt32(&srv.gets); gets != 3 {
+		t.Errorf(`expected 3 GET requests, got %d`, gets)
+	}
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, srv.content) {
+		t.Errorf(`downloaded file differs from served content (%d / %d bytes)`, len(got), len(srv.content))
+	}
+}
+
+func TestErrorStatusIsNotSaved(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	srv.failGets, srv.failStatus = 10, 403
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 2, RetryWait: 10 * time.Millisecond}
+	path := filepath.Join(t.TempDir(), `file.bin`)
+	err := fd.New(&conf).SimpleFileDownload(srv.URL+`/file.bin`, path)
+	var statusErr *fd.StatusError
+	if !errors.As(err, &statusErr) || !statusErr.ClientError() {
+		t.Fatalf(`expected client status error, got %v`, err)
+	}
+	if gets := atomic.LoadInt32(&srv.gets); gets != 1 {
+		t.Errorf(`client error must not be retried, got %d GET requests`, gets)
+	}
+	for _, p := range []string{path, path + `.part`} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf(`error page must not be left at %s: %v`, p, err)
+		}
+	}
+}
+
+func TestServerErrorIsRetried(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	srv.failGets, srv.failStatus = 2, 503
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 2, RetryWait: 10 * time.Millisecond}
+	path := filepath.Join(t.TempDir(), `file.bin`)
+	if err := fd.New(&conf).SimpleFileDownload(srv.URL+`/file.bin`, path); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, srv.content) {
+		t.Errorf(`downloaded file differs from served content`)
+	}
+}
@@ -0,0 +1,198 @@
+package test
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+// waitProbed waits until the size of every enqueued file is known.
+func waitProbed(t *testing.T, fdl *fd.FileDownloader) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		probed := true
+		for _, f := range fdl.Stats().Files {
+			probed = probed && f.Total >= 0
+		}
+		if probed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(`size requests didn't finish`)
+}
+
+func TestRoundRobinAcrossHosts(t *testing.T) {
+	a, b := newTestServer(t, 16*1024), newTestServer(t, 16*1024)
+	dir := t.TempDir()
+	var (
+		mu     sync.Mutex
+		starts []string
+	)
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, Hooks: fd.Hooks{OnStart: func(e fd.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(e.Download.URL, a.URL) {
+			starts = append(starts, `a`)
+		} else {
+			starts = append(starts, `b`)
+		}
+	}}}
+	fdl := fd.New(&conf)
+	for i := 0; i < 6; i++ {
+		fdl.Enqueue(&fd.Download{URL: a.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, fmt.Sprintf(`a%d.bin`, i))})
+	}
+	for i := 0; i < 2; i++ {
+		fdl.Enqueue(&fd.Download{URL: b.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, fmt.Sprintf(`b%d.bin`, i))})
+	}
+	waitProbed(t, fdl)
+	fdl.Start()
+	fdl.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(starts, ``); got != `ababaaaa` {
+		t.Errorf(`expected hosts to take turns, downloads started in order %s`, got)
+	}
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	a, b := newTestServer(t, 256*1024), newTestServer(t, 256*1024)
+	a.slowFirst, b.slowFirst = true, true
+	dir := t.TempDir()
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 4, MaxConnsPerHost: 1}
+	var downloads []*fd.Download
+	for i := 0; i < 3; i++ {
+		downloads = append(downloads,
+			&fd.Download{URL: a.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, fmt.Sprintf(`a%d.bin`, i))},
+			&fd.Download{URL: b.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, fmt.Sprintf(`b%d.bin`, i))})
+	}
+	if _, err := fd.New(&conf).MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	for _, srv := range []*testServer{a, b} {
+		if max := atomic.LoadInt32(&srv.maxInFlight); max != 1 {
+			t.Errorf(`expected a single connection per host, got %d`, max)
+		}
+	}
+}
+
+func TestMaxConnsPerHostSmallFiles(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	srv.slow = true
+	dir := t.TempDir()
+	// files this small are downloaded with a single connection each
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 4, MaxConnsPerHost: 4, SegmentsPerFile: 4}
+	var downloads []*fd.Download
+	for i := 0; i < 8; i++ {
+		downloads = append(downloads, &fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, fmt.Sprintf(`%d.bin`, i))})
+	}
+	if _, err := fd.New(&conf).MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	if max := atomic.LoadInt32(&srv.maxInFlight); max < 2 || max > 4 {
+		t.Errorf(`expected small files to be downloaded in parallel, got %d connections at once`, max)
+	}
+}
+
+// startOrder downloads the files with a single thread once their sizes are known, and returns the order they started in.
+func startOrder(t *testing.T, conf fd.Config, downloads []*fd.Download, before func(*fd.FileDownloader, []fd.JobID)) []fd.JobID {
+	var (
+		mu     sync.Mutex
+		starts []fd.JobID
+	)
+	conf.LogFunc, conf.MaxDownloadThreads = myLogger, 1
+	conf.Hooks.OnStart = func(e fd.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		starts = append(starts, e.ID)
+	}
+	fdl := fd.New(&conf)
+	var ids []fd.JobID
+	for _, d := range downloads {
+		ids = append(ids, fdl.Enqueue(d))
+	}
+	waitProbed(t, fdl)
+	if before != nil {
+		before(fdl, ids)
+	}
+	fdl.Start()
+	fdl.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	return starts
+}
+
+func TestOrderBySize(t *testing.T) {
+	dir := t.TempDir()
+	var downloads []*fd.Download
+	for i, size := range []int{48 * 1024, 16 * 1024, 32 * 1024} {
+		srv := newTestServer(t, size)
+		downloads = append(downloads, &fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, fmt.Sprintf(`%d.bin`, i))})
+	}
+	for _, test := range []struct {
+		conf fd.Config
+		want []fd.JobID
+	}{
+		{fd.Config{Order: fd.OrderAsGiven}, []fd.JobID{1, 2, 3}},
+		{fd.Config{Order: fd.OrderSmallestFirst}, []fd.JobID{2, 3, 1}},
+		{fd.Config{Order: fd.OrderLargestFirst}, []fd.JobID{1, 3, 2}},
+	} {
+		if got := startOrder(t, test.conf, downloads, nil); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf(`%s: expected start order %v, got %v`, test.conf.Order, test.want, got)
+		}
+	}
+}
+
+func TestOrderBySizeWaitsForSizes(t *testing.T) {
+	dir := t.TempDir()
+	var downloads []*fd.Download
+	for i, size := range []int{4 * 1024 * 1024, 16 * 1024, 32 * 1024} {
+		srv := newTestServer(t, size)
+		if i > 0 {
+			// the sizes of the small files are known after the big one's
+			srv.headDelay = 100 * time.Millisecond
+		}
+		downloads = append(downloads, &fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, fmt.Sprintf(`%d.bin`, i))})
+	}
+	var (
+		mu     sync.Mutex
+		starts []string
+	)
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, Order: fd.OrderSmallestFirst, Hooks: fd.Hooks{OnStart: func(e fd.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		starts = append(starts, filepath.Base(e.Download.LocalFilePath))
+	}}}
+	if _, err := fd.New(&conf).MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(starts, ` `); got != `1.bin 2.bin 0.bin` {
+		t.Errorf(`expected smallest files first, downloads started in order %s`, got)
+	}
+}
+
+func TestOrderByPriority(t *testing.T) {
+	srv := newTestServer(t, 16*1024)
+	dir := t.TempDir()
+	var downloads []*fd.Download
+	for i, priority := range []int{0, 1, 2, 1} {
+		downloads = append(downloads, &fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, fmt.Sprintf(`%d.bin`, i)), Priority: priority})
+	}
+	got := startOrder(t, fd.Config{Order: fd.OrderPriority}, downloads, func(fdl *fd.FileDownloader, ids []fd.JobID) {
+		// the first one is urgent now
+		if !fdl.SetPriority(ids[0], 5) {
+			t.Error(`priority of queued job could not be changed`)
+		}
+	})
+	if want := []fd.JobID{1, 3, 2, 4}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf(`expected start order %v, got %v`, want, got)
+	}
+}
@@ -0,0 +1,55 @@
+package test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+func TestSegmentedDownload(t *testing.T) {
+	srv := newTestServer(t, 16*1024*1024+123)
+	srv.slowFirst = true
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, SegmentsPerFile: 4}
+	path := filepath.Join(t.TempDir(), `file.bin`)
+	if err := fd.New(&conf).SimpleFileDownload(srv.URL+`/file.bin`, path); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, srv.content) {
+		t.Fatalf(`segmented file differs from served content (%d / %d bytes)`, len(got), len(srv.content))
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, r := range srv.ranges {
+		if !strings.HasPrefix(r, `bytes=`) {
+			t.Errorf(`segment requested without range: %q`, r)
+		}
+	}
+	// the slow first segment has to be taken over by idle connections
+	if len(srv.ranges) <= 4 {
+		t.Errorf(`expected stolen segments besides the first 4, got ranges %v`, srv.ranges)
+	}
+}
+
+func TestSegmentedDownloadFallsBackWithoutRanges(t *testing.T) {
+	srv := newTestServer(t, 4*1024*1024)
+	srv.ignoreRange = true
+	// no retry is needed to continue with a single connection
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, SegmentsPerFile: 4}
+	path := filepath.Join(t.TempDir(), `file.bin`)
+	results, err := fd.New(&conf).MultipleFileDownload([]*fd.Download{{URL: srv.URL + `/file.bin`, LocalFilePath: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; r.Attempts != 1 {
+		t.Errorf(`expected a single attempt, got %+v`, r)
+	}
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, srv.content) {
+		t.Fatalf(`file differs from served content (%d / %d bytes)`, len(got), len(srv.content))
+	}
+}
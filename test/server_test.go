@@ -0,0 +1,167 @@
+package test
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// local http server for tests which don't need internet access.
+
+type testServer struct {
+	*httptest.Server
+	content     []byte
+	etag        string        // ETag of content
+	failGets    int32         // number of GET requests which fail
+	failStatus  int           // status the failing GET requests get, 0 cuts them off after an eighth of the file
+	retryAfter  string        // Retry-After header of the failing GET requests
+	stallGets   int32         // number of GET requests after the failing ones which hang after an eighth of the file until the client gives up
+	ignoreRange bool          // answer every GET with the whole file like servers without range support
+	changed     []byte        // content served to GET requests, as if the file changed after HEAD
+	slowFirst   bool          // send the beginning of the file slowly
+	slow        bool          // send every response slowly
+	noHead      bool          // refuse HEAD requests
+	headDelay   time.Duration // wait before answering HEAD requests
+	chunked     bool          // send the file without length and range support
+	gets        int32         // number of GET requests received
+	inFlight    int32         // GET requests being answered
+	maxInFlight int32         // most GET requests answered at once
+
+	mu       sync.Mutex
+	ranges   []string // Range header of every GET request
+	ifRanges []string // If-Range header of every GET request
+}
+
+func newTestServer(t testing.TB, size int) *testServer {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+	s := &testServer{content: content, etag: `"v1"`}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == `/missing` {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodHead {
+		time.Sleep(s.headDelay)
+	}
+	if r.Method == http.MethodHead && s.noHead {
+		http.Error(w, `no HEAD`, http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method == http.MethodGet {
+		n := atomic.AddInt32(&s.gets, 1)
+		inFlight := atomic.AddInt32(&s.inFlight, 1)
+		defer atomic.AddInt32(&s.inFlight, -1)
+		for max := atomic.LoadInt32(&s.maxInFlight); inFlight > max; max = atomic.LoadInt32(&s.maxInFlight) {
+			if atomic.CompareAndSwapInt32(&s.maxInFlight, max, inFlight) {
+				break
+			}
+		}
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get(`Range`))
+		s.ifRanges = append(s.ifRanges, r.Header.Get(`If-Range`))
+		s.mu.Unlock()
+		if n <= atomic.LoadInt32(&s.failGets) && s.failStatus != 0 {
+			if s.retryAfter != "" {
+				w.Header().Set(`Retry-After`, s.retryAfter)
+			}
+			http.Error(w, `<html>failed</html>`, s.failStatus)
+			return
+		}
+		if n <= atomic.LoadInt32(&s.failGets) {
+			// drop the connection half way through the body
+			w = &cutWriter{ResponseWriter: w, left: len(s.content) / 8}
+		} else if n <= atomic.LoadInt32(&s.failGets)+atomic.LoadInt32(&s.stallGets) {
+			w = &stallWriter{ResponseWriter: w, left: len(s.content) / 8, done: r.Context().Done()}
+		}
+	}
+	if s.chunked {
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(s.content[:len(s.content)/2])
+			w.(http.Flusher).Flush()
+			w.Write(s.content[len(s.content)/2:])
+		}
+		return
+	}
+	content, etag := s.content, s.etag
+	if r.Method == http.MethodGet && s.changed != nil {
+		content, etag = s.changed, `"v2"`
+	}
+	if s.ignoreRange {
+		r.Header.Del(`Range`)
+	}
+	if rng := r.Header.Get(`Range`); s.slow || s.slowFirst && (rng == "" || strings.HasPrefix(rng, `bytes=0-`)) {
+		w = &slowWriter{w}
+	}
+	w.Header().Set(`ETag`, etag)
+	http.ServeContent(w, r, `file.bin`, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), bytes.NewReader(content))
+}
+
+// slowWriter sends a response in small delayed pieces.
+type slowWriter struct {
+	http.ResponseWriter
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := 32 * 1024
+		if n > len(p) {
+			n = len(p)
+		}
+		time.Sleep(50 * time.Millisecond)
+		nw, err := w.ResponseWriter.Write(p[:n])
+		written += nw
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// stallWriter stops sending after left bytes of the body and keeps the connection open until done.
+type stallWriter struct {
+	http.ResponseWriter
+	left int
+	done <-chan struct{}
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+	if len(p) > w.left {
+		n, _ := w.ResponseWriter.Write(p[:w.left])
+		w.left -= n
+		w.ResponseWriter.(http.Flusher).Flush()
+		<-w.done
+		panic(http.ErrAbortHandler)
+	}
+	w.left -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// cutWriter drops the connection after left bytes of the body.
+type cutWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (w *cutWriter) Write(p []byte) (int, error) {
+	if len(p) > w.left {
+		w.ResponseWriter.Write(p[:w.left])
+		panic(http.ErrAbortHandler)
+	}
+	w.left -= len(p)
+	return w.ResponseWriter.Write(p)
+}
@@ -0,0 +1,68 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+func TestStallTimeout(t *testing.T) {
+	srv := newTestServer(t, 1024*1024)
+	srv.stallGets = 1
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, MaxRetry: 1, RetryWait: 10 * time.Millisecond, StallTimeout: 300 * time.Millisecond}
+	path := filepath.Join(t.TempDir(), `file.bin`)
+	start := time.Now()
+	results, err := fd.New(&conf).MultipleFileDownload([]*fd.Download{{URL: srv.URL + `/file.bin`, LocalFilePath: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf(`stalled connection was aborted after %s`, elapsed)
+	}
+	if results[0].Attempts != 2 {
+		t.Errorf(`expected a retry after the stall, got %d attempts`, results[0].Attempts)
+	}
+	// the retry resumes after the bytes received before the stall
+	if rng := srv.ranges[1]; !strings.HasPrefix(rng, `bytes=`) || strings.HasPrefix(rng, `bytes=0-`) {
+		t.Errorf(`expected resumed range after stall, got %q`, rng)
+	}
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, srv.content) {
+		t.Errorf(`downloaded file differs from served content (%d / %d bytes)`, len(got), len(srv.content))
+	}
+}
+
+func TestStallWithoutRetry(t *testing.T) {
+	srv := newTestServer(t, 1024*1024)
+	srv.stallGets = 1
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, StallTimeout: 200 * time.Millisecond}
+	err := fd.New(&conf).SimpleFileDownload(srv.URL+`/file.bin`, filepath.Join(t.TempDir(), `file.bin`))
+	if !errors.Is(err, fd.ErrStalled) {
+		t.Errorf(`expected ErrStalled, got %v`, err)
+	}
+}
+
+func TestMinSpeed(t *testing.T) {
+	srv := newTestServer(t, 2*1024*1024)
+	// 640 KiB per second from the start of the file, a resumed range is fast
+	srv.slowFirst = true
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, MaxRetry: 1, RetryWait: 10 * time.Millisecond,
+		MinSpeed: 4 * 1024 * 1024, MinSpeedPeriod: 300 * time.Millisecond}
+	start := time.Now()
+	results, err := fd.New(&conf).MultipleFileDownload([]*fd.Download{{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(t.TempDir(), `file.bin`)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf(`slow connection was not replaced, took %s`, elapsed)
+	}
+	if r := results[0]; r.Attempts != 2 || r.BytesWritten != int64(len(srv.content)) {
+		t.Errorf(`expected a resumed retry after the slow attempt, got %+v`, r)
+	}
+}
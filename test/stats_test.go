@@ -0,0 +1,70 @@
+package test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	fd "github.com/sysgoblin/godownload/cmd"
+)
+
+func TestStatsSubscription(t *testing.T) {
+	srv := newTestServer(t, 2*1024*1024)
+	srv.slowFirst = true
+	dir := t.TempDir()
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, DownloadTimeout: time.Minute}
+	fdl := fd.New(&conf)
+	stats, unsubscribe := fdl.Subscribe()
+	// never read, it must not stall the download
+	fdl.Subscribe()
+	fdl.Start()
+	id := fdl.Enqueue(&fd.Download{URL: srv.URL + `/file.bin`, LocalFilePath: filepath.Join(dir, `file.bin`)})
+	size := int64(len(srv.content))
+	var running fd.Stats
+	for s := range stats {
+		if s.Active == 1 && s.Files[0].Done > 0 {
+			running = s
+			break
+		}
+	}
+	f := running.Files[0]
+	if f.ID != id || f.State != fd.StateDownloading || f.Total != size || f.Done >= size || f.Connections != 1 || f.Attempts != 1 {
+		t.Errorf(`unexpected stats of running download: %+v`, f)
+	}
+	if f.Speed <= 0 || f.ETA <= 0 || running.Speed != f.Speed || running.ETA <= 0 || running.Total != size {
+		t.Errorf(`expected speed and eta of running download: %+v`, running)
+	}
+	fdl.Wait()
+	unsubscribe()
+	unsubscribe()
+	for range stats {
+		// ends when unsubscribe has closed the channel
+	}
+	done := fdl.Stats()
+	if f := done.Files[0]; f.State != fd.StateDone || f.Done != size || f.Connections != 0 {
+		t.Errorf(`unexpected stats of finished download: %+v`, f)
+	}
+	if done.Active != 0 || done.Done != size || done.ETA != 0 {
+		t.Errorf(`unexpected stats after download: %+v`, done)
+	}
+	fdl.Close()
+}
+
+func TestProgressChannelsAreKept(t *testing.T) {
+	srv := newTestServer(t, 64*1024)
+	conf := fd.Config{LogFunc: myLogger, MaxDownloadThreads: 1, RequiresDetailProgress: true}
+	fdl := fd.New(&conf)
+	progress := fdl.ProgressChan
+	for _, name := range []string{`a.bin`, `b.bin`} {
+		if err := fdl.SimpleFileDownload(srv.URL+`/file.bin`, filepath.Join(t.TempDir(), name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fdl.ProgressChan != progress || cap(progress) == 0 {
+		t.Error(`expected the buffered progress channel of New to be kept`)
+	}
+	fdl.Close()
+	for range progress {
+		// ends when Close has closed the channel
+	}
+}